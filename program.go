@@ -1,16 +1,41 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode"
 
 	"github.com/Azure/azure-sdk-for-go/arm/compute"
 	"github.com/Azure/azure-sdk-for-go/arm/disk"
@@ -21,6 +46,7 @@ import (
 	"github.com/Azure/azure-sdk-for-go/arm/resources/subscriptions"
 	"github.com/Azure/azure-sdk-for-go/arm/storage"
 	keys "github.com/Azure/azure-sdk-for-go/dataplane/keyvault"
+	blobs "github.com/Azure/azure-sdk-for-go/storage"
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/Azure/go-autorest/autorest/azure"
@@ -37,14 +63,447 @@ var (
 
 var (
 	errLog    *log.Logger
+	warnLog   *log.Logger
 	statusLog *log.Logger
 	debugLog  *log.Logger
 	wait      bool
 )
 
+// sender is shared by every client in this sample, so that policies like rate limiting apply to the run as a whole instead of per-client.
+var sender autorest.Sender = &http.Client{}
+
+// correlationID is sent with every request made during a run, so that Azure support can find all of them from a single ID.
+var correlationID = uuid.NewV4()
+
+var (
+	lbBackendPoolID  string
+	regionPairBackup bool
+	scriptFile       string
+	scriptContent    []byte
+	maxRPS           float64
+	deviceCodeJSON   bool
+	openBrowser      bool
+	autoUpgradeMinor bool
+	autoRegister     bool
+	computerName     string
+	osType           string
+	unattendFile     string
+	unattendPass     string
+	unattendComp     string
+	unattendSetting  string
+	unattendContent  string
+	timeZone         string
+	secretsVault     string
+	certificateURLs  certificateList
+	certificateStore string
+	resourceTagSets  tagSets
+	exportTemplate   string
+	publicIPID       string
+	noPublicIP       bool
+	ipForwarding     bool
+	pollInterval     time.Duration
+	asyncPolling     bool
+	cloudInitFile    string
+	cloudInitContent []byte
+	location         string
+	vmSize           string
+	listSizes        bool
+	restartVM        bool
+	existingVM       string
+	listExtensions   bool
+	listTenants      bool
+	reapplyVM        bool
+	compareExt       bool
+	withStatus       bool
+	checkQuota       bool
+	checkNames       bool
+	preflight        bool
+	extensionTimeout time.Duration
+	bootTimeout      time.Duration
+	nicCount         int
+	dnsLabel         string
+	extensionType    string
+	extensionTypes   extensionList
+	skipExtension    bool
+	accessUsername   string
+	adminUsername    string
+	accessPassword   string
+	accessKeyFile    string
+	accessKey        string
+	createNSG        bool
+	nsgScope         string
+	handlerVersion   string
+	eventsFile       string
+	flowLogs         bool
+	keepOnError      bool
+	forceDelete      bool
+	noCleanup        bool
+	dumpOnFailure    bool
+	settingsFile     string
+	protectedFile    string
+	settingsObject   map[string]interface{}
+	protectedObject  map[string]interface{}
+	namePrefix       string
+	nameSuffix       string
+	namingScheme     string
+	naming           namingStrategy
+	reportHostKeys   bool
+	sshKeyOut        string
+	forceOverwrite   bool
+	sshPublicKey     string
+	osDiskCaching    string
+	sourceSnapshot   string
+	osDiskName       string
+	dataDiskName     string
+	licenseType      string
+	existingGroup    string
+	locationSet      bool
+	groupLocation    string
+	interactive      bool
+	assumeYes        bool
+	requestTimeout   time.Duration
+	recordDir        string
+	summaryFile      string
+	outputDir        string
+	existingVNet     string
+	existingSubnet   string
+	vnetGroup        string
+	collectionRuleID string
+)
+
+// dnsLabelPattern matches the domain name labels Azure accepts for a Public IP Address: 3 to 63 lowercase letters, digits, and hyphens,
+// starting with a letter and not ending with a hyphen.
+var dnsLabelPattern = regexp.MustCompile(`^[a-z][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// dataCollectionRulePattern matches the resource ID of an Azure Monitor data collection rule.
+var dataCollectionRulePattern = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Insights/dataCollectionRules/[^/]+$`)
+
+// snapshotPattern matches the resource ID of a managed disk snapshot.
+var snapshotPattern = regexp.MustCompile(`(?i)^/subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft\.Compute/snapshots/([^/]+)$`)
+
+// vaultPattern matches the resource ID of a Key Vault.
+var vaultPattern = regexp.MustCompile(`(?i)^/subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft\.KeyVault/vaults/([^/]+)$`)
+
+// publicIPPattern matches the resource ID of a Public IP Address.
+var publicIPPattern = regexp.MustCompile(`(?i)^/subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft\.Network/publicIPAddresses/([^/]+)$`)
+
+// pairedRegions maps each Azure region to the region it is paired with for disaster recovery purposes.
+// See: https://docs.microsoft.com/azure/best-practices-availability-paired-regions
+var pairedRegions = map[string]string{
+	"australiaeast":      "australiasoutheast",
+	"australiasoutheast": "australiaeast",
+	"brazilsouth":        "southcentralus",
+	"canadacentral":      "canadaeast",
+	"canadaeast":         "canadacentral",
+	"centralindia":       "southindia",
+	"centralus":          "eastus2",
+	"eastasia":           "southeastasia",
+	"eastus":             "westus",
+	"eastus2":            "centralus",
+	"japaneast":          "japanwest",
+	"japanwest":          "japaneast",
+	"koreacentral":       "koreasouth",
+	"koreasouth":         "koreacentral",
+	"northcentralus":     "southcentralus",
+	"northeurope":        "westeurope",
+	"southcentralus":     "northcentralus",
+	"southeastasia":      "eastasia",
+	"southindia":         "centralindia",
+	"uksouth":            "ukwest",
+	"ukwest":             "uksouth",
+	"westcentralus":      "westus2",
+	"westeurope":         "northeurope",
+	"westindia":          "southindia",
+	"westus":             "eastus",
+	"westus2":            "westcentralus",
+}
+
+// requiredProviders are the resource provider namespaces that must be registered with a subscription in order to run this sample.
+var requiredProviders = []string{
+	"Microsoft.Compute",
+	"Microsoft.KeyVault",
+	"Microsoft.Network",
+	"Microsoft.Storage",
+}
+
+// insightsProvider is the resource provider namespace behind Azure Monitor, which Network Watcher relies on to write flow logs, and which
+// holds data collection rules.
+const insightsProvider = "Microsoft.Insights"
+
+// reapplyAPIVersion is the Microsoft.Compute API version used to reapply a VM's state, which the vendored compute client predates.
+const reapplyAPIVersion = "2019-07-01"
+
+// dataCollectionAPIVersion is the Microsoft.Insights API version used to associate a data collection rule with the VM.
+const dataCollectionAPIVersion = "2021-04-01"
+
+// noCleanupEnv names the environment variable that supplies the default for -no-cleanup, for pipelines that can't change their flags.
+const noCleanupEnv = "ARMVMEXT_NO_CLEANUP"
+
+// marketplaceAPIVersion is the Microsoft.MarketplaceOrdering API version used to check whether the terms of an image's plan were accepted.
+const marketplaceAPIVersion = "2015-06-01"
+
+// flowLogsContainer is the blob container that Network Watcher writes Network Security Group flow logs to.
+const flowLogsContainer = "insights-logs-networksecuritygroupflowevent"
+
+// resourceGroupPattern finds the Resource Group named in a resource ID.
+var resourceGroupPattern = regexp.MustCompile(`(?i)/resourceGroups/([^/]+)/`)
+
+// The operating systems this sample knows how to provision.
+const (
+	osLinux   = "linux"
+	osWindows = "windows"
+)
+
+// The extensions this sample can install on the VM once it has been created, through -extension-type.
+const (
+	extensionDiskEncryption = "disk-encryption"
+	extensionVMAccess       = "vmaccess"
+	extensionMonitorAgent   = "ama"
+)
+
+// supportedExtensionTypes lists the values -extension-type and -extension accept.
+var supportedExtensionTypes = []string{extensionDiskEncryption, extensionVMAccess, extensionMonitorAgent}
+
+// The places a Network Security Group created through -nsg can be associated with, chosen through -nsg-scope.
+const (
+	nsgScopeSubnet = "subnet"
+	nsgScopeNIC    = "nic"
+)
+
+// handlerVersionPattern matches an extension handler version of the form major.minor.
+var handlerVersionPattern = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+
+// extensionTypeNames is the type of the extension that each value of -extension-type installs, by operating system.
+var extensionTypeNames = map[string]map[string]string{
+	extensionDiskEncryption: {osLinux: "AzureDiskEncryptionForLinux", osWindows: "AzureDiskEncryption"},
+	extensionVMAccess:       {osLinux: "VMAccessForLinux", osWindows: "VMAccessAgent"},
+	extensionMonitorAgent:   {osLinux: "AzureMonitorLinuxAgent", osWindows: "AzureMonitorWindowsAgent"},
+}
+
+// compatibleHandlerMajors are the major handler versions of each extension this sample has been written against, by extension type.
+var compatibleHandlerMajors = map[string][]string{
+	"AzureDiskEncryptionForLinux": {"0", "1"},
+	"AzureDiskEncryption":         {"1", "2"},
+	"VMAccessForLinux":            {"1"},
+	"VMAccessAgent":               {"2"},
+	"AzureMonitorLinuxAgent":      {"1"},
+	"AzureMonitorWindowsAgent":    {"1"},
+}
+
+// nameRule describes the names Azure accepts for one type of resource.
+type nameRule struct {
+	maxLength int
+	pattern   *regexp.Regexp
+}
+
+// The naming rules for the resources whose names are affected by -name-prefix and -name-suffix.
+// See: https://docs.microsoft.com/azure/architecture/best-practices/naming-conventions
+var (
+	resourceGroupNameRule = nameRule{90, regexp.MustCompile(`^[-\w.()]*[-\w()]$`)}
+	vmNameRule            = nameRule{64, regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9._]*[a-zA-Z0-9_])?$`)}
+	networkNameRule       = nameRule{80, regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9._]*[a-zA-Z0-9_])?$`)}
+	diskNameRule          = nameRule{80, regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9._]*[a-zA-Z0-9_])?$`)}
+)
+
+// namingStrategy chooses the names of the resources this sample creates, before -name-prefix and -name-suffix are applied. A strategy
+// gives the same name each time it's asked for the same resource, so that names can be worked out again wherever they're needed.
+type namingStrategy interface {
+	ResourceGroupName() string
+	VMName(i int) string
+	NICName(i int) string
+}
+
+// guidNaming makes names unique by ending them with a uuid generated for the run. It is the default.
+type guidNaming struct {
+	id uuid.UUID
+}
+
+func (naming guidNaming) ResourceGroupName() string {
+	return "sample-rg" + naming.id.String()
+}
+
+func (naming guidNaming) VMName(i int) string {
+	return indexedName("sample-vm"+naming.id.String(), i)
+}
+
+func (guidNaming) NICName(i int) string {
+	return indexedName("sample-networkInterface", i)
+}
+
+// timestampNaming ends names with the time the run started, so that resources sort by when they were made.
+type timestampNaming struct {
+	started time.Time
+}
+
+func (naming timestampNaming) stamp() string {
+	return naming.started.UTC().Format("20060102-150405")
+}
+
+func (naming timestampNaming) ResourceGroupName() string {
+	return "sample-rg-" + naming.stamp()
+}
+
+func (naming timestampNaming) VMName(i int) string {
+	return indexedName("sample-vm-"+naming.stamp(), i)
+}
+
+func (naming timestampNaming) NICName(i int) string {
+	return indexedName("sample-networkInterface-"+naming.stamp(), i)
+}
+
+// indexedName distinguishes all but the first of several resources of the same kind by appending i to name.
+func indexedName(name string, i int) string {
+	if i > 0 {
+		return fmt.Sprintf("%s-%d", name, i)
+	}
+	return name
+}
+
+// licenseTypeOffers is the marketplace image offer each license type accepted by -license-type can be applied to.
+var licenseTypeOffers = map[string]string{
+	"Windows_Server": "WindowsServer",
+	"Windows_Client": "Windows-10",
+	"RHEL_BYOS":      "RHEL",
+	"SLES_BYOS":      "SLES",
+}
+
+// adminPasswordLength is the range of password lengths Azure accepts for a VM's administrator, by operating system.
+// See: https://docs.microsoft.com/azure/virtual-machines/windows/faq
+var adminPasswordLength = map[string][2]int{
+	osLinux:   {6, 72},
+	osWindows: {8, 123},
+}
+
+// reservedUsernames are the user names Azure refuses to give a VM's accounts, by operating system.
+// See: https://docs.microsoft.com/azure/virtual-machines/linux/faq and https://docs.microsoft.com/azure/virtual-machines/windows/faq
+var reservedUsernames = map[string][]string{
+	osLinux: {
+		"1", "123", "a", "actuser", "adm", "admin", "admin1", "admin2", "administrator", "aspnet", "backup", "console", "david", "guest", "john",
+		"owner", "root", "server", "sql", "support", "support_388945a0", "sys", "test", "test1", "test2", "test3", "user", "user1", "user2",
+		"user3", "user4", "user5", "video",
+	},
+	osWindows: {
+		"1", "123", "a", "actuser", "adm", "admin", "admin1", "admin2", "administrator", "aspnet", "backup", "console", "david", "guest", "john",
+		"owner", "root", "server", "sql", "support", "support_388945a0", "sys", "test", "test1", "test2", "test3", "user", "user1", "user2",
+		"user3", "user4", "user5",
+	},
+}
+
+// maxUsernameLength is the longest user name Azure accepts for a VM's accounts, by operating system.
+var maxUsernameLength = map[string]int{
+	osLinux:   64,
+	osWindows: 20,
+}
+
+// maxComputerNameLength is the longest host name Azure accepts for a VM, by operating system.
+var maxComputerNameLength = map[string]int{
+	osLinux:   64,
+	osWindows: 15,
+}
+
+// maxNetworkInterfaces is the number of network interfaces that can be attached to a VM, for the sizes this sample knows about.
+// See: https://docs.microsoft.com/azure/virtual-machines/windows/sizes
+var maxNetworkInterfaces = map[compute.VirtualMachineSizeTypes]int{
+	compute.StandardD1:     2,
+	compute.StandardD2:     2,
+	compute.StandardD3:     4,
+	compute.StandardD4:     8,
+	compute.StandardD11:    2,
+	compute.StandardD12:    4,
+	compute.StandardD13:    8,
+	compute.StandardD14:    8,
+	compute.StandardD1V2:   2,
+	compute.StandardD2V2:   2,
+	compute.StandardD3V2:   4,
+	compute.StandardD4V2:   8,
+	compute.StandardD5V2:   8,
+	compute.StandardD11V2:  2,
+	compute.StandardD12V2:  4,
+	compute.StandardD13V2:  8,
+	compute.StandardD14V2:  8,
+	compute.StandardD15V2:  8,
+	compute.StandardDS1:    2,
+	compute.StandardDS2:    2,
+	compute.StandardDS3:    4,
+	compute.StandardDS4:    8,
+	compute.StandardDS11:   2,
+	compute.StandardDS12:   4,
+	compute.StandardDS13:   8,
+	compute.StandardDS14:   8,
+	compute.StandardDS1V2:  2,
+	compute.StandardDS2V2:  2,
+	compute.StandardDS3V2:  4,
+	compute.StandardDS4V2:  8,
+	compute.StandardDS5V2:  8,
+	compute.StandardDS11V2: 2,
+	compute.StandardDS12V2: 4,
+	compute.StandardDS13V2: 8,
+	compute.StandardDS14V2: 8,
+	compute.StandardDS15V2: 8,
+}
+
+// The bounds of the -poll-interval flag.
+const (
+	minPollInterval = time.Second
+	maxPollInterval = 5 * time.Minute
+)
+
+// maxCustomDataLength is the largest amount of custom data, before being base64 encoded, that Azure will pass to a VM.
+const maxCustomDataLength = 64 * 1024
+
+// maxUnattendContentLength is the largest unattend.xml snippet Azure accepts.
+const maxUnattendContentLength = 4 * 1024
+
+// windowsTimeZones are the time zone IDs Windows recognizes, as listed by `tzutil /l`, in order of their offset from UTC.
+var windowsTimeZones = []string{
+	"Dateline Standard Time", "UTC-11", "Aleutian Standard Time", "Hawaiian Standard Time", "Marquesas Standard Time",
+	"Alaskan Standard Time", "UTC-09", "Pacific Standard Time (Mexico)", "UTC-08", "Pacific Standard Time", "US Mountain Standard Time",
+	"Mountain Standard Time (Mexico)", "Mountain Standard Time", "Yukon Standard Time", "Central America Standard Time",
+	"Central Standard Time", "Easter Island Standard Time", "Central Standard Time (Mexico)", "Canada Central Standard Time",
+	"SA Pacific Standard Time", "Eastern Standard Time (Mexico)", "Eastern Standard Time", "Haiti Standard Time", "Cuba Standard Time",
+	"US Eastern Standard Time", "Turks And Caicos Standard Time", "Paraguay Standard Time", "Atlantic Standard Time",
+	"Venezuela Standard Time", "Central Brazilian Standard Time", "SA Western Standard Time", "Pacific SA Standard Time",
+	"Newfoundland Standard Time", "Tocantins Standard Time", "E. South America Standard Time", "SA Eastern Standard Time",
+	"Argentina Standard Time", "Greenland Standard Time", "Montevideo Standard Time", "Magallanes Standard Time",
+	"Saint Pierre Standard Time", "Bahia Standard Time", "UTC-02", "Mid-Atlantic Standard Time", "Azores Standard Time",
+	"Cape Verde Standard Time", "UTC", "GMT Standard Time", "Greenwich Standard Time", "Sao Tome Standard Time", "Morocco Standard Time",
+	"W. Europe Standard Time", "Central Europe Standard Time", "Romance Standard Time", "Central European Standard Time",
+	"W. Central Africa Standard Time", "Jordan Standard Time", "GTB Standard Time", "Middle East Standard Time", "Egypt Standard Time",
+	"E. Europe Standard Time", "Syria Standard Time", "West Bank Standard Time", "South Africa Standard Time", "FLE Standard Time",
+	"Israel Standard Time", "South Sudan Standard Time", "Kaliningrad Standard Time", "Sudan Standard Time", "Libya Standard Time",
+	"Namibia Standard Time", "Arabic Standard Time", "Turkey Standard Time", "Arab Standard Time", "Belarus Standard Time",
+	"Russian Standard Time", "E. Africa Standard Time", "Volgograd Standard Time", "Iran Standard Time", "Arabian Standard Time",
+	"Astrakhan Standard Time", "Azerbaijan Standard Time", "Russia Time Zone 3", "Mauritius Standard Time", "Saratov Standard Time",
+	"Georgian Standard Time", "Caucasus Standard Time", "Afghanistan Standard Time", "West Asia Standard Time", "Qyzylorda Standard Time",
+	"Ekaterinburg Standard Time", "Pakistan Standard Time", "India Standard Time", "Sri Lanka Standard Time", "Nepal Standard Time",
+	"Central Asia Standard Time", "Bangladesh Standard Time", "Omsk Standard Time", "Myanmar Standard Time", "SE Asia Standard Time",
+	"Altai Standard Time", "W. Mongolia Standard Time", "North Asia Standard Time", "N. Central Asia Standard Time", "Tomsk Standard Time",
+	"China Standard Time", "North Asia East Standard Time", "Singapore Standard Time", "W. Australia Standard Time", "Taipei Standard Time",
+	"Ulaanbaatar Standard Time", "Aus Central W. Standard Time", "Transbaikal Standard Time", "Tokyo Standard Time",
+	"North Korea Standard Time", "Korea Standard Time", "Yakutsk Standard Time", "Cen. Australia Standard Time", "AUS Central Standard Time",
+	"E. Australia Standard Time", "AUS Eastern Standard Time", "West Pacific Standard Time", "Tasmania Standard Time",
+	"Vladivostok Standard Time", "Lord Howe Standard Time", "Bougainville Standard Time", "Russia Time Zone 10", "Magadan Standard Time",
+	"Norfolk Standard Time", "Sakhalin Standard Time", "Central Pacific Standard Time", "Russia Time Zone 11", "New Zealand Standard Time",
+	"UTC+12", "Fiji Standard Time", "Kamchatka Standard Time", "Chatham Islands Standard Time", "UTC+13", "Tonga Standard Time",
+	"Samoa Standard Time", "Line Islands Standard Time",
+}
+
+// computerNamePattern matches the host names Azure accepts for a VM: letters, digits, and hyphens, not starting or ending with a hyphen.
+var computerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+// missingNamespacePattern finds the namespace named in a MissingSubscriptionRegistration error message.
+var missingNamespacePattern = regexp.MustCompile(`namespace '([^']+)'`)
+
+// lbBackendPoolPattern matches the resource ID of a backend address pool belonging to an Azure Load Balancer.
+var lbBackendPoolPattern = regexp.MustCompile(`(?i)^/subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft\.Network/loadBalancers/([^/]+)/backendAddressPools/([^/]+)$`)
+
+// exitExtensionTimeout is the exit status used when an extension doesn't finish provisioning within -extension-timeout.
+const exitExtensionTimeout = 2
+
+// exitDrift is the exit status used when -compare-extension finds that an extension differs from the one this sample would install.
+const exitDrift = 3
+
 const (
-	location                      = "WESTUS2"
-	vmProfile                     = compute.StandardDS2V2
 	servicePrincipalApplicationID = "INSERT YOUR SERVICE PRINCIPAL APPLICATION ID HERE"
 
 	// You can find this using the azure CLI 2.0 by running the following command after replacing {servicePrincipalApplicationID}:
@@ -54,67 +513,228 @@ const (
 )
 
 func main() {
+	parseArgs()
+	if err := run(); err != nil {
+		errLog.Print(err)
+		if namespace, ok := missingRegistration(err); ok && namespace != "" {
+			errLog.Printf("The selected subscription isn't registered to use %s. Register it by running `az provider register --namespace %s`, or run this sample again with -auto-register.", namespace, namespace)
+		} else if ok {
+			errLog.Print("The selected subscription is missing a resource provider registration. Run this sample again with -auto-register.")
+		}
+
+		if _, ok := err.(extensionTimeoutError); ok {
+			os.Exit(exitExtensionTimeout)
+		}
+		if _, ok := err.(driftError); ok {
+			os.Exit(exitDrift)
+		}
+		os.Exit(1)
+	}
+}
+
+// run creates the sample's assets, installs the chosen extensions, and then deletes everything it created. All cleanup has been done
+// by the time it returns.
+func run() (err error) {
+	if exportTemplate != "" {
+		if err = writeTemplate(exportTemplate); err != nil {
+			return fmt.Errorf("could not export template. Error: %v", err)
+		}
+		statusLog.Print("Exported Template: ", exportTemplate)
+		return nil
+	}
+
+	if outputDir != "" && protectedFile == "" {
+		path := filepath.Join(outputDir, "template.json")
+		if err = writeTemplate(path); err != nil {
+			return fmt.Errorf("could not write template '%s'. Error: %v", path, err)
+		}
+		debugLog.Print("Wrote Template: ", path)
+	}
+
+	if summaryFile != "" {
+		defer func() {
+			if writeErr := summary.write(summaryFile, err); writeErr != nil {
+				errLog.Printf("could not write summary file '%s'. Error: %v", summaryFile, writeErr)
+			} else {
+				statusLog.Print("Wrote Summary: ", summaryFile)
+			}
+		}()
+	}
+
+	cleanup, err := provision()
+	defer func() {
+		if cleanupErr := cleanup(); cleanupErr != nil {
+			errLog.Print(cleanupErr)
+		}
+	}()
+	return
+}
+
+// provision creates the sample's assets and installs the chosen extensions. It returns a cleanup func that deletes the assets this run
+// created, leaving an existing Resource Group and what was already in it alone, and honoring -keep-on-error. The cleanup func is never nil,
+// and is safe to call after provision fails partway through, as well as more than once; only the first call deletes anything. If provision
+// panics, it cleans up itself before letting the panic continue, since the cleanup func never reaches the caller.
+func provision() (cleanup func() error, err error) {
+	var steps cleanupSteps
+	cleanup = steps.run
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			// Record the panic as the outcome of the run, so that -keep-on-error still applies.
+			err = fmt.Errorf("panic: %v", recovered)
+			if cleanupErr := cleanup(); cleanupErr != nil {
+				errLog.Print(cleanupErr)
+			}
+			panic(recovered)
+		}
+	}()
+
 	var group resources.Group
 	var sampleVM compute.VirtualMachine
-	var sampleNetwork network.VirtualNetwork
 	var sampleStorageAccount storage.Account
 	var sampleVault keyvault.Vault
 	var token *adal.Token
 	var authorizer *autorest.BearerAuthorizer
 	var vaultAuthorizer autorest.Authorizer
 	var currentUser graphrbac.AADObject
-	var err error
 
-	exitStatus := 1
-	defer func() {
-		os.Exit(exitStatus)
-	}()
+	statusLog.Print("Correlation ID: ", correlationID)
+
+	if preflight {
+		finish := beginStep("check-connectivity")
+		if err = finish(checkConnectivity(environment.ActiveDirectoryEndpoint, environment.ResourceManagerEndpoint)); err != nil {
+			return
+		}
+	}
 
 	// Get authenticated so we can access the subscription used to run this sample.
-	if temp, err := authenticate(userClientID); err == nil {
+	finish := beginStep("authenticate")
+	authContext, stopAuthentication := interruptible()
+	temp, authErr := authenticate(authContext, userClientID)
+	stopAuthentication()
+	if finish(authErr) == nil {
 		token = temp
 		authorizer = autorest.NewBearerAuthorizer(token)
 	} else {
-		errLog.Printf("could not authenticate. Error: %v", err)
-		return
+		return cleanup, fmt.Errorf("could not authenticate. Error: %v", authErr)
 	}
 
-	subscriptionResults, subscriptionErrs := getSubscriptions(authorizer)
-	var subscriptionCache []subscriptions.Subscription
-	for subscription := range subscriptionResults {
-		subscriptionCache = append(subscriptionCache, subscription)
+	if listTenants {
+		return cleanup, printTenants(authorizer)
 	}
-	err = <-subscriptionErrs
-	if err != nil {
-		errLog.Print(err)
-		return
+
+	if userSubscriptionID == uuid.Nil {
+		finish = beginStep("select-subscription")
+		userSubscriptionID, err = selectSubscription(authorizer)
+		if finish(err) != nil {
+			return
+		}
 	}
 
-	var selectedSubscription subscriptions.Subscription
-	if subCount := len(subscriptionCache); subCount == 1 {
-		selectedSubscription = subscriptionCache[0]
-	} else {
-		var selected int
-		fmt.Println("Multiple subscriptions are associated with this account.\nPlease select the subscription you would like to use from the following list:")
-		for i, currentSub := range subscriptionCache {
-			fmt.Printf("\t%d) %s\n", i, *currentSub.DisplayName)
+	if existingGroup != "" {
+		finish = beginStep("get-resource-group")
+		group, err = getResourceGroup(userSubscriptionID, existingGroup, authorizer)
+		if finish(err) != nil {
+			return cleanup, fmt.Errorf("could not find resource group '%s'. Error: %v", existingGroup, err)
 		}
-		fmt.Print("Selection: ")
-		_, err = fmt.Scanf("%d", &selected)
-		if err != nil {
-			errLog.Print(err)
+		if !locationSet {
+			location = *group.Location
+			statusLog.Print("Using Location of Resource Group: ", location)
+		} else if !strings.EqualFold(location, *group.Location) {
+			// Assets are placed in the region of the group they're created in, so honor -location by overriding it.
+			debugLog.Printf("Creating Assets in %s, instead of %s", location, *group.Location)
+			group.Location = to.StringPtr(location)
+		}
+	}
+
+	if groupLocation != "" {
+		finish = beginStep("check-locations")
+		if err = finish(ensureLocations(userSubscriptionID, authorizer, location, groupLocation)); err != nil {
 			return
 		}
-		selectedSubscription = subscriptionCache[selected]
 	}
 
-	var parsed uuid.UUID
-	parsed, err = uuid.FromString(*selectedSubscription.SubscriptionID)
-	if err != nil {
-		errLog.Print(err)
+	if restartVM {
+		finish = beginStep("restart-virtual-machine")
+		if err = finish(restartVirtualMachine(userSubscriptionID, *group.Name, existingVM, authorizer)); err != nil {
+			return
+		}
+		statusLog.Print("Restarted Virtual Machine: ", existingVM)
+		return
+	}
+
+	if reapplyVM {
+		finish = beginStep("reapply-virtual-machine")
+		if err = finish(reapplyVirtualMachine(userSubscriptionID, *group.Name, existingVM, authorizer)); err != nil {
+			return
+		}
+		statusLog.Print("Reapplied Virtual Machine: ", existingVM)
 		return
 	}
-	userSubscriptionID = parsed
+
+	if listExtensions {
+		return cleanup, printExtensions(userSubscriptionID, *group.Name, existingVM, authorizer)
+	}
+
+	if compareExt {
+		return cleanup, compareExtensions(userSubscriptionID, *group.Name, existingVM, authorizer)
+	}
+
+	if listSizes {
+		return cleanup, printVMSizes(userSubscriptionID, location, authorizer)
+	}
+
+	if autoRegister {
+		providers := requiredProviders
+		if flowLogs || collectionRuleID != "" {
+			providers = append(providers, insightsProvider)
+		}
+		finish = beginStep("register-providers")
+		err = registerProviders(userSubscriptionID, authorizer, providers...)
+		if finish(err) != nil {
+			return
+		}
+	}
+
+	if existingGroup != "" && (osDiskName != "" || dataDiskName != "") {
+		finish = beginStep("check-disk-names")
+		if err = finish(ensureDisksAbsent(userSubscriptionID, *group.Name, authorizer, osDiskName, dataDiskName)); err != nil {
+			return
+		}
+	}
+
+	if secretsVault != "" {
+		finish = beginStep("check-secrets-vault")
+		if err = finish(checkSecretsVault(secretsVault, location, authorizer)); err != nil {
+			return
+		}
+	}
+
+	// The Storage Account's name is chosen up front, so that it can be checked along with any DNS label before anything is created.
+	storageName := storageAccountName()
+	if checkNames {
+		finish = beginStep("check-name-availability")
+		if err = finish(checkNameAvailability(userSubscriptionID, location, storageName, authorizer)); err != nil {
+			return
+		}
+	}
+
+	if checkQuota {
+		finish = beginStep("check-quota")
+		if err = finish(ensureQuota(userSubscriptionID, location, vmSize, authorizer)); err != nil {
+			return
+		}
+	}
+
+	// Images sold through the marketplace can't be deployed until their terms are accepted, which Azure otherwise only reports once the VM
+	// is being created.
+	var imagePlan *compute.Plan
+	if sourceSnapshot == "" {
+		finish = beginStep("check-image-terms")
+		imagePlan, err = checkImageTerms(userSubscriptionID, location, authorizer)
+		if finish(err) != nil {
+			return
+		}
+	}
 
 	// Get AAD ObjectID of the currently authenticated user to give them and only them access to the Key Vault created below.
 	var stuff *adal.OAuthConfig
@@ -127,85 +747,155 @@ func main() {
 	if err != nil {
 		return
 	}
+	foo.SetSender(sender)
 	err = foo.Refresh()
 	if err != nil {
-		errLog.Print(err)
 		return
 	}
 
 	graphClient := graphrbac.NewObjectsClient(userTenantID.String())
 	graphClient.Authorizer = autorest.NewBearerAuthorizer(foo)
+	graphClient.Sender = sender
+	graphClient.PollingDelay = pollInterval
 
 	currentUser, err = graphClient.GetCurrentUser()
 	if err != nil {
-		errLog.Print(err)
 		return
 	}
 	var userID uuid.UUID
 	userID, err = uuid.FromString(*currentUser.ObjectID)
 	if err != nil {
-		errLog.Print(err)
 		return
 	}
 
-	// Create a Resource Group to act as a sandbox for this sample.
-	if temp, deleter, err := setupResourceGroup(userSubscriptionID, authorizer); err == nil {
+	if interactive {
+		var proceed bool
+		if proceed, err = confirmPlan(userSubscriptionID); err != nil {
+			return
+		} else if !proceed {
+			statusLog.Print("Cancelled, no assets were created.")
+			return
+		}
+	}
+
+	// Create a Resource Group to act as a sandbox for this sample, unless an existing one was chosen.
+	if existingGroup != "" {
+		statusLog.Print("Using Existing Resource Group: ", *group.Name)
+		summary.addResource("Resource Group (existing)", *group.Name)
+		steps.add(func() error {
+			statusLog.Print("Leaving Assets in Existing Resource Group: ", *group.Name)
+			return nil
+		})
+	} else {
+		finish = beginStep("create-resource-group")
+		temp, deleter, groupErr := setupResourceGroup(userSubscriptionID, authorizer)
+		if finish(groupErr) != nil {
+			return cleanup, fmt.Errorf("could not create resource group. Error: %v", groupErr)
+		}
 		group = temp
+		if !strings.EqualFold(location, *group.Location) {
+			// As with an existing group, assets are placed in the group's region unless told otherwise.
+			debugLog.Printf("Creating Assets in %s, instead of %s", location, *group.Location)
+			group.Location = to.StringPtr(location)
+		}
 		statusLog.Print("Created Resource Group: ", *group.Name)
-		defer func() {
+		summary.addResource("Resource Group", *group.Name)
+		// err is read when the cleanup runs, after provision has returned, so it holds the outcome of the whole run.
+		steps.add(func() error {
+			if noCleanup {
+				statusLog.Print("Leaving Resource Group in Place: ", *group.Name)
+				return nil
+			}
+			if keepOnError && err != nil {
+				statusLog.Print("Keeping Resource Group After Failure: ", *group.Name)
+				return nil
+			}
 			if wait {
 				fmt.Print("press ENTER to continue...")
 				fmt.Scanln()
 			}
 			statusLog.Print("Deleting Resource Group: ", *group.Name)
-			if deleted := <-deleter(); deleted != nil {
-				errLog.Print(deleted)
-			}
-		}()
+			finishDelete := beginStep("delete-resource-group")
+			return finishDelete(<-deleter())
+		})
+	}
+
+	// The Virtual Network's subnet, or the VM's network interfaces, need the Network Security Group to exist before they can be associated with it.
+	var securityGroup *network.SecurityGroup
+	if createNSG {
+		var created network.SecurityGroup
+		finish = beginStep("create-network-security-group")
+		created, err = setupNetworkSecurityGroup(userSubscriptionID.String(), *group.Name, authorizer)
+		if finish(err) != nil {
+			return
+		}
+		statusLog.Print("Created Network Security Group: ", *created.Name)
+		summary.addResource("Network Security Group", *created.Name)
+		debugLog.Print("Network Security Group Scope: ", nsgScope)
+		securityGroup = &network.SecurityGroup{ID: created.ID}
+	}
+
+	var subnetSecurityGroup, interfaceSecurityGroup *network.SecurityGroup
+	if nsgScope == nsgScopeSubnet {
+		subnetSecurityGroup = securityGroup
 	} else {
-		errLog.Printf("could not create resource group. Error: %v", err)
-		return
+		interfaceSecurityGroup = securityGroup
 	}
 
-	defer func() {
-		if err != nil {
-			errLog.Print(err)
+	var sampleSubnet network.Subnet
+	if existingVNet != "" {
+		finish = beginStep("get-subnet")
+		sampleSubnet, err = getSubnet(userSubscriptionID, vnetGroup, existingVNet, existingSubnet, authorizer)
+		if finish(err) != nil {
+			return
 		}
-	}()
+		statusLog.Printf("Using Existing Subnet: %s/%s (%s)", existingVNet, existingSubnet, *sampleSubnet.AddressPrefix)
+		summary.addResource("Subnet (existing)", existingVNet+"/"+existingSubnet)
+	}
 
 	// Create Pre-requisites for a VM. Because they are independent, we can do so in parallel.
-	storageAccountResults, storageAccountErrs := setupStorageAccount(userSubscriptionID, group, authorizer)
-	virtualNetworkResults, virtualNetworkErrs := setupVirtualNetwork(userSubscriptionID, group, authorizer)
+	finishStorageAccount := beginStep("create-storage-account")
+	finishVault := beginStep("create-key-vault")
+	storageAccountResults, storageAccountErrs := setupStorageAccount(userSubscriptionID, group, storageName, authorizer)
 	vaultResults, vaultErrs := setupKeyVault(userID, userSubscriptionID, userTenantID, group, authorizer)
 
 	var wg1 sync.WaitGroup
-	wg1.Add(3)
-
-	go func() {
-		defer wg1.Done()
-		sampleNetwork = <-virtualNetworkResults
-		if err = <-virtualNetworkErrs; err != nil {
-			return
-		}
-		statusLog.Print("Created Virtual Network: ", *sampleNetwork.Name)
-	}()
+	wg1.Add(2)
+
+	if existingVNet == "" {
+		finishVirtualNetwork := beginStep("create-virtual-network")
+		virtualNetworkResults, virtualNetworkErrs := setupVirtualNetwork(userSubscriptionID, group, subnetSecurityGroup, authorizer)
+		wg1.Add(1)
+		go func() {
+			defer wg1.Done()
+			sampleNetwork := <-virtualNetworkResults
+			if err = finishVirtualNetwork(<-virtualNetworkErrs); err != nil {
+				return
+			}
+			sampleSubnet = (*sampleNetwork.Subnets)[0]
+			statusLog.Print("Created Virtual Network: ", *sampleNetwork.Name)
+			summary.addResource("Virtual Network", *sampleNetwork.Name)
+		}()
+	}
 
 	go func() {
 		defer wg1.Done()
 		sampleStorageAccount = <-storageAccountResults
-		if err = <-storageAccountErrs; err != nil {
+		if err = finishStorageAccount(<-storageAccountErrs); err != nil {
 			return
 		}
 		statusLog.Print("Created Storage Account: ", *sampleStorageAccount.Name)
+		summary.addResource("Storage Account", *sampleStorageAccount.Name)
 	}()
 
 	go func() {
 		defer wg1.Done()
 		sampleVault = <-vaultResults
-		if err = <-vaultErrs; err != nil {
+		if err = finishVault(<-vaultErrs); err != nil {
 			return
 		}
 		statusLog.Print("Created Key Vault: ", *sampleVault.Name)
+		summary.addResource("Key Vault", *sampleVault.Name)
 	}()
 
 	wg1.Wait()
@@ -213,72 +903,350 @@ func main() {
 		return
 	}
 
+	if flowLogs {
+		finish = beginStep("enable-flow-logs")
+		err = setupFlowLogs(userSubscriptionID, group, *securityGroup, sampleStorageAccount, authorizer)
+		if finish(err) != nil {
+			return
+		}
+		statusLog.Printf("Enabled Flow Logs: %s%s", to.String(sampleStorageAccount.PrimaryEndpoints.Blob), flowLogsContainer)
+	}
+
 	vaultAuthorizer, err = vaultAuthentication(userClientID, userTenantID, *token)
 
+	finish = beginStep("create-managed-disk")
 	dataDiskResults, dataDiskErrs := setupManagedDisk(userClientID, userSubscriptionID, userTenantID, group, sampleStorageAccount, sampleVault, authorizer, vaultAuthorizer)
 
-	if err = <-dataDiskErrs; err != nil {
+	if err = finish(<-dataDiskErrs); err != nil {
 		return
 	}
+	dataDisk := <-dataDiskResults
+	summary.addResource("Data Disk", *dataDisk.Name)
 
 	// Create an Azure Virtual Machine, on which we'll mount an encrypted data disk.
-	sampleVM, err = setupVirtualMachine(userClientID, userSubscriptionID, userTenantID, group, sampleStorageAccount, sampleVault, vaultAuthorizer, <-dataDiskResults, (*sampleNetwork.Subnets)[0], authorizer, nil)
-	if err != nil {
-		return
+	machinesClient := compute.NewVirtualMachinesClient(userSubscriptionID.String())
+	machinesClient.Authorizer = authorizer
+	machinesClient.Sender = sender
+	machinesClient.PollingDelay = pollInterval
+
+	interfacesClient := network.NewInterfacesClient(userSubscriptionID.String())
+	interfacesClient.Authorizer = authorizer
+	interfacesClient.Sender = sender
+	interfacesClient.PollingDelay = pollInterval
+
+	var osDisk *disk.Model
+	if sourceSnapshot != "" {
+		var copied disk.Model
+		finish = beginStep("copy-os-disk-from-snapshot")
+		copied, err = setupOSDisk(userSubscriptionID, group, sourceSnapshot, authorizer)
+		if finish(err) != nil {
+			return
+		}
+		statusLog.Print("Copied OS Disk From Snapshot: ", *copied.Name)
+		summary.addResource("OS Disk", *copied.Name)
+		osDisk = &copied
 	}
-	statusLog.Print("Created Virtual Machine: ", *sampleVM.Name)
 
-	var kekBundle keys.KeyBundle
-	kekBundle, err = setupEncryptionKey(userClientID, userTenantID, vaultAuthorizer, sampleVault)
-	if err != nil {
-		return
+	if sshKeyOut != "" {
+		finish = beginStep("generate-ssh-key")
+		sshPublicKey, err = writeSSHKey(sshKeyOut, forceOverwrite)
+		if finish(err) != nil {
+			return
+		}
+		statusLog.Print("Wrote SSH Private Key: ", sshKeyOut)
 	}
-	statusLog.Print("Created KEK: ", *kekBundle.Key.Kid)
 
-	extClient := compute.NewVirtualMachineExtensionsClient(userSubscriptionID.String())
-	extClient.Authorizer = authorizer
-
-	_, extErrs := extClient.CreateOrUpdate(*group.Name, *sampleVM.Name, "AzureDiskEncryptionForLinux", compute.VirtualMachineExtension{
-		Location: to.StringPtr("WESTUS2"),
-		VirtualMachineExtensionProperties: &compute.VirtualMachineExtensionProperties{
-			AutoUpgradeMinorVersion: to.BoolPtr(true),
-			ProtectedSettings: &map[string]interface{}{
-				"AADClientSecret": servicePrincipalSectet, // The Secret that was created for the service principal secret.
-				"Passphrase":      "yourPassPhrase",       // This sample uses a simple passphrase, but you should absolutely use something more sophisticated.
-			},
-			Publisher: to.StringPtr("Microsoft.Azure.Security"),
-			Settings: &map[string]interface{}{
-				"AADClientID":               servicePrincipalApplicationID,
-				"EncryptionOperation":       "EnableEncryption",
-				"KeyEncryptionAlgorithm":    "RSA-OAEP",
-				"KeyEncryptionKeyAlgorithm": *kekBundle.Key.Kid,
-				"KeyVaultURL":               vaultURL(sampleVault),
-				"SequenceVersion":           uuid.NewV4().String(),
-				"VolumeType":                "ALL",
-			},
-			Type:               to.StringPtr("AzureDiskEncryptionForLinux"),
-			TypeHandlerVersion: to.StringPtr("0.1"),
-		},
-	}, nil)
+	// The name is settled here, so that the diagnostics collected for the VM are for the one that is created.
+	vmName := resourceName(naming.VMName(0))
+	if dumpOnFailure {
+		// Registered before the VM is created, since a VM that fails to provision still exists and is worth a look. It runs before the
+		// Resource Group is deleted, as the cleanup goes in reverse.
+		steps.add(func() error {
+			if err == nil {
+				return nil
+			}
+			path, dumpErr := dumpDiagnostics(userSubscriptionID, group, vmName, sampleStorageAccount, err, authorizer)
+			if dumpErr != nil {
+				warnLog.Print("could not collect diagnostics. Error: ", dumpErr)
+			} else if path != "" {
+				statusLog.Print("Wrote Diagnostics: ", path)
+			}
+			return nil
+		})
+	}
 
-	if err = <-extErrs; err != nil {
+	finish = beginStep("create-virtual-machine")
+	var machines vmCreator = machinesClient
+	if asyncPolling {
+		machines = progressReportingMachines{machinesClient}
+	}
+	sampleVM, err = setupVirtualMachine(machines, interfacesClient, userClientID, userSubscriptionID, userTenantID, group, vmName, sampleStorageAccount, sampleVault, vaultAuthorizer, dataDisk, osDisk, imagePlan, sampleSubnet, interfaceSecurityGroup, authorizer, nil)
+	if finish(err) != nil {
 		return
 	}
-	statusLog.Print("Disk Encryption Extension Added")
+	statusLog.Print("Created Virtual Machine: ", *sampleVM.Name)
+	summary.addResource("Virtual Machine", *sampleVM.Name)
+	if osDisk == nil && sampleVM.StorageProfile != nil && sampleVM.StorageProfile.OsDisk != nil && sampleVM.StorageProfile.OsDisk.Name != nil {
+		summary.addResource("OS Disk", *sampleVM.StorageProfile.OsDisk.Name)
+	}
+
+	if bootTimeout > 0 {
+		finish = beginStep("wait-for-boot")
+		if err = finish(waitForBoot(machinesClient, userSubscriptionID, group, *sampleVM.Name, sampleStorageAccount, authorizer)); err != nil {
+			return
+		}
+		statusLog.Print("Virtual Machine Running: ", *sampleVM.Name)
+	}
+
+	if scriptContent != nil {
+		var scriptExtension compute.VirtualMachineExtension
+		finish = beginStep("install-custom-script-extension")
+		scriptExtension, err = setupCustomScriptExtension(userSubscriptionID, group, sampleVM, scriptContent, authorizer)
+		if finish(err) != nil {
+			return
+		}
+		statusLog.Print("Custom Script Extension Added: ", *scriptExtension.Name)
+		summary.addExtension(scriptExtension)
+	}
+
+	if reportHostKeys {
+		var fingerprints []string
+		finish = beginStep("report-host-keys")
+		fingerprints, err = getHostKeys(userSubscriptionID, group, sampleVM, authorizer)
+		if finish(err) != nil {
+			return
+		}
+		for _, fingerprint := range fingerprints {
+			statusLog.Print("SSH Host Key: ", fingerprint)
+		}
+		summary.hostKeys = fingerprints
+	}
+
+	if skipExtension {
+		statusLog.Print("Skipping Extensions, as -skip-extension was given")
+	}
+
+	// Extensions are installed one at a time, in the order they were requested, stopping at the first that fails.
+	var installed []string
+	for _, current := range extensionTypes {
+		var extension compute.VirtualMachineExtension
+		switch current {
+		case extensionVMAccess:
+			finish = beginStep("install-vmaccess-extension")
+			extension, err = installExtension(userSubscriptionID, group, sampleVM, vmAccessExtension(to.StringPtr(location), accessPassword), authorizer)
+			if finish(err) != nil {
+				return
+			}
+			statusLog.Print("VM Access Extension Added, Credentials Reset For: ", accessUsername)
+		case extensionMonitorAgent:
+			finish = beginStep("install-monitor-agent-extension")
+			extension, err = installExtension(userSubscriptionID, group, sampleVM, monitorAgentExtension(to.StringPtr(location)), authorizer)
+			if finish(err) != nil {
+				return
+			}
+			statusLog.Print("Azure Monitor Agent Extension Added")
+
+			if collectionRuleID != "" {
+				finish = beginStep("associate-data-collection-rule")
+				if err = finish(associateDataCollectionRule(userSubscriptionID, sampleVM, collectionRuleID, authorizer)); err != nil {
+					return
+				}
+				statusLog.Print("Associated Data Collection Rule: ", collectionRuleID)
+			}
+		case extensionDiskEncryption:
+			var kekBundle keys.KeyBundle
+			finish = beginStep("create-key-encryption-key")
+			kekBundle, err = setupEncryptionKey(userClientID, userTenantID, vaultAuthorizer, sampleVault)
+			if finish(err) != nil {
+				return
+			}
+			statusLog.Print("Created KEK: ", *kekBundle.Key.Kid)
+
+			encryptionExtension := diskEncryptionExtension(to.StringPtr(location), vaultURL(sampleVault), *kekBundle.Key.Kid, servicePrincipalSectet)
+			finish = beginStep("install-disk-encryption-extension")
+			extension, err = installExtension(userSubscriptionID, group, sampleVM, encryptionExtension, authorizer)
+			if finish(err) != nil {
+				return
+			}
+			statusLog.Print("Disk Encryption Extension Added")
+		}
+		installed = append(installed, fmt.Sprintf("%s (%s)", *extension.Name, to.String(extension.ProvisioningState)))
+		summary.addExtension(extension)
+	}
+	if len(installed) > 1 {
+		statusLog.Print("Installed Extensions: ", strings.Join(installed, ", "))
+	}
+
+	if command := connectCommand(summary.fqdn, summary.address); command != "" {
+		statusLog.Print("Connect With: ", command)
+	}
+
+	if regionPairBackup {
+		var backupGroup resources.Group
+		var backupDeleter func() <-chan error
+		finish = beginStep("create-region-pair-backup")
+		backupGroup, backupDeleter, err = setupRegionPairBackup(userSubscriptionID, group, authorizer)
+		if finish(err) != nil {
+			return
+		}
+		statusLog.Printf("Created Disaster Recovery Resource Group: %s (%s)", *backupGroup.Name, *backupGroup.Location)
+		summary.addResource("Disaster Recovery Resource Group", *backupGroup.Name)
+		steps.add(func() error {
+			if noCleanup {
+				statusLog.Print("Leaving Disaster Recovery Resource Group in Place: ", *backupGroup.Name)
+				return nil
+			}
+			if keepOnError && err != nil {
+				statusLog.Print("Keeping Disaster Recovery Resource Group After Failure: ", *backupGroup.Name)
+				return nil
+			}
+			statusLog.Print("Deleting Disaster Recovery Resource Group: ", *backupGroup.Name)
+			finishDelete := beginStep("delete-region-pair-backup")
+			return finishDelete(<-backupDeleter())
+		})
+	}
 
-	exitStatus = 0
+	return cleanup, nil
 }
 
-func init() {
-	var badArgs bool
+// cleanupSteps collects the work owed to clean up after a run, to be done in the reverse of the order it was added in, as deferred calls
+// would be.
+type cleanupSteps struct {
+	once  sync.Once
+	steps []func() error
+	err   error
+}
+
+func (c *cleanupSteps) add(step func() error) {
+	c.steps = append(c.steps, step)
+}
+
+// run carries out every step, even after one fails, and reports the failures together. Only the first call does anything; later calls
+// report the same outcome.
+func (c *cleanupSteps) run() error {
+	c.once.Do(func() {
+		var failures []string
+		for i := len(c.steps) - 1; i >= 0; i-- {
+			if stepErr := c.steps[i](); stepErr != nil {
+				failures = append(failures, stepErr.Error())
+			}
+		}
+		if len(failures) > 0 {
+			c.err = fmt.Errorf("could not clean up. Error: %s", strings.Join(failures, "; "))
+		}
+	})
+	return c.err
+}
 
+func init() {
 	errLog = log.New(os.Stderr, "[ERROR] ", 0)
+	warnLog = log.New(os.Stderr, "[WARNING] ", 0)
 	statusLog = log.New(os.Stdout, "[STATUS] ", log.Ltime)
+	debugLog = log.New(ioutil.Discard, "[DEBUG] ", 0)
+}
 
-	// unformattedSubscriptionID := flag.String("subscription", os.Getenv("AZURE_SUBSCRIPTION_ID"), "The subscription that will be targeted when running this sample.")
-	// unformattedTenantID := flag.String("tenant", os.Getenv("AZURE_TENANT_ID"), "The tenant that hosts the subscription to be used by this sample.")
+// parseArgs reads this sample's flags and validates them, reporting every problem it finds at once. It exits if there are any.
+func parseArgs() {
+	var problems []error
+
+	unformattedSubscriptionID := flag.String("subscription", os.Getenv("AZURE_SUBSCRIPTION_ID"), "The subscription that will be targeted when running this sample. Defaults to the Azure CLI's default subscription, if there is one.")
+	unformattedTenantID := flag.String("tenant", os.Getenv("AZURE_TENANT_ID"), "The tenant that hosts the subscription to be used by this sample.")
+	unformattedClientID := flag.String("client-id", "04b07795-8ddb-461a-bbee-02f9e1bf7b46", "The application that signs in on behalf of the user. Defaults to the Azure CLI's, which was chosen for its public well-known status.")
 	printDebug := flag.Bool("debug", false, "Include debug information in the output of this program.")
+	flag.StringVar(&outputDir, "output-dir", "", "A directory to collect everything this run produces in: the template describing its assets (template.json), its report (summary.md), its events (events.jsonl), its log (run.log), and the instance view of each extension installed (extension-{name}.json). -summary-file and -events-jsonl take precedence.")
+	flag.StringVar(&summaryFile, "summary-file", "", "At the end of the run, write a Markdown report of what was created, how long each step took, and how to connect to the VM to this file.")
+	flag.StringVar(&eventsFile, "events-jsonl", "", "Also write a JSON object to this file as each step of the sample starts and finishes, one per line. Use '-' for stdout.")
+	flag.StringVar(&namePrefix, "name-prefix", "", "Text added to the start of the names of the Resource Group, VM, network interfaces, and Public IP Address that are created.")
+	flag.StringVar(&nameSuffix, "name-suffix", "", "Text added to the end of the names of the Resource Group, VM, network interfaces, and Public IP Address that are created.")
+	flag.StringVar(&namingScheme, "naming", "guid", "How the Resource Group, VM, and network interfaces are named. Either 'guid' to end names with a random uuid, or 'timestamp' to end them with the time the run started.")
+	// Like -subscription and -tenant, the environment only supplies the default, so -no-cleanup takes precedence when both are given.
+	var defaultNoCleanup bool
+	if raw := os.Getenv(noCleanupEnv); raw != "" {
+		parsed, parseErr := strconv.ParseBool(raw)
+		if parseErr != nil {
+			problems = append(problems, fmt.Errorf("'%s' is not a valid value for %s. This sample expects '1', 'true', '0', or 'false'", raw, noCleanupEnv))
+		}
+		defaultNoCleanup = parsed
+	}
+	flag.BoolVar(&noCleanup, "no-cleanup", defaultNoCleanup, "Leave the Resource Group this sample creates, and everything in it, in place when the sample finishes, instead of deleting it. Defaults to the value of "+noCleanupEnv+", if it's set.")
+	flag.BoolVar(&forceDelete, "force-delete", false, "Force delete the VM when the sample deletes its Resource Group, which skips shutting it down gracefully to finish sooner.")
+	flag.BoolVar(&dumpOnFailure, "dump-on-failure", false, "If the sample fails once it has started creating the VM, write the state of the VM, its extensions, and its network interfaces, along with its serial console log, to a diagnostics-{time}.json file in -output-dir, or the working directory.")
+	flag.BoolVar(&keepOnError, "keep-on-error", false, "If the sample fails after creating its Resource Group, leave the group and everything in it in place for inspection, instead of deleting it.")
 	flag.BoolVar(&wait, "wait", false, "Use to wait for user acknowledgement before deletion of the created assets.")
+	flag.BoolVar(&interactive, "interactive", false, "Use to review what will be created, and confirm it, before any assets are created.")
+	flag.BoolVar(&assumeYes, "yes", false, "Use with -interactive to print what will be created without asking for confirmation.")
+	flag.StringVar(&location, "location", "WESTUS2", "The Azure region in which assets are created. When -resource-group is used, defaults to the region of that group.")
+	flag.StringVar(&groupLocation, "resource-group-location", "", "The Azure region recorded as the location of the Resource Group this sample creates. Assets in the group are still created in -location. Defaults to -location.")
+	flag.StringVar(&existingGroup, "resource-group", "", "The name of an existing Resource Group to create the sample's assets in, instead of creating a new one. Assets created in an existing group are left in place when the sample finishes.")
+	flag.StringVar(&vmSize, "vm-size", string(compute.StandardDS2V2), "The size of the VM that is created. Use -list-sizes to see the sizes available in a region.")
+	flag.BoolVar(&restartVM, "restart-vm", false, "Restart the existing VM named by -vm-name in -resource-group, wait for it to come back, then exit without creating any assets.")
+	flag.StringVar(&existingVM, "vm-name", "", "The name of the VM to restart with -restart-vm, to list the extensions of with -list-extensions, or to reapply with -reapply-vm.")
+	flag.BoolVar(&reapplyVM, "reapply-vm", false, "Reapply the state Azure holds for the existing VM named by -vm-name in -resource-group, including its extensions, wait for that to finish, then exit without creating any assets. Useful when an extension is stuck after a transient failure.")
+	flag.BoolVar(&listTenants, "tenant-discovery", false, "Sign in, list the IDs of the tenants the signed in account can access, for use with -tenant, then exit without creating any assets.")
+	flag.BoolVar(&compareExt, "compare-extension", false, "Compare the publisher, type, handler version, and settings of each extension chosen with -extension-type or -extension against those installed on the existing VM named by -vm-name in -resource-group, print any differences, then exit without creating any assets. Exits with status 3 when they differ. Protected settings can't be read back, so they aren't compared.")
+	flag.BoolVar(&listExtensions, "list-extensions", false, "List the extensions installed on the existing VM named by -vm-name in -resource-group, then exit without creating any assets.")
+	flag.BoolVar(&withStatus, "with-status", false, "Include each extension's current status message and time in the output of -list-extensions.")
+	flag.BoolVar(&listSizes, "list-sizes", false, "List the VM sizes available in the region selected with -location, then exit without creating any assets.")
+	flag.BoolVar(&preflight, "preflight", true, "Before signing in, ensure the Azure Active Directory and Azure Resource Manager endpoints can be reached, so that network and proxy problems are reported plainly.")
+	flag.BoolVar(&checkNames, "check-name-availability", true, "Before creating any assets, ensure the globally unique names this run uses, for its Storage Account and -dns-label, aren't already taken.")
+	flag.BoolVar(&checkQuota, "check-quota", true, "Before creating any assets, ensure the subscription has enough remaining vCPU quota in the selected region for the VM.")
+	flag.BoolVar(&asyncPolling, "async-polling", false, "Follow the creation of the VM by polling the operation Azure reports through the Azure-AsyncOperation or Location header directly, logging each status and percentage complete it reports along the way.")
+	flag.DurationVar(&pollInterval, "poll-interval", 10*time.Second, "How long to wait between checks on the status of long running operations. Must be between 1s and 5m.")
+	flag.BoolVar(&regionPairBackup, "region-pair-backup", false, "After creating all assets, also create an empty Resource Group named after the sample's in the paired region to act as a disaster recovery target.")
+	flag.BoolVar(&openBrowser, "open-browser", false, "During sign-in, open the device login page in the default browser and copy the user code to the clipboard.")
+	flag.BoolVar(&deviceCodeJSON, "device-code-json", false, "In addition to the sign-in instructions, print the device code details as a single line of JSON so that wrapping tools can present their own prompt.")
+	flag.StringVar(&recordDir, "record-to", "", "A directory to save every HTTP request made, and the response to it, in. Credentials and secrets are redacted from what is saved.")
+	flag.DurationVar(&requestTimeout, "request-timeout", time.Minute, "How long to wait for Azure to respond to any single HTTP request before giving up on it. Use 0 for no limit.")
+	flag.Float64Var(&maxRPS, "max-rps", 5, "The maximum number of requests per second this sample will send to Azure, across all operations. Use 0 to disable throttling.")
+	flag.BoolVar(&autoRegister, "auto-register", false, "Register the resource providers this sample needs with the selected subscription, if they aren't already.")
+	flag.DurationVar(&bootTimeout, "boot-timeout", 0, "Once the VM has been provisioned, how long to wait for it to be running before giving up. By default, the VM isn't waited on.")
+	flag.DurationVar(&extensionTimeout, "extension-timeout", 0, "How long to wait for each extension to finish provisioning before giving up. By default, there is no limit.")
+	flag.StringVar(&extensionType, "extension-type", extensionDiskEncryption, "The extension to install on the VM once it has been created. Either 'disk-encryption', 'vmaccess', which resets the credentials of a user on the VM, or 'ama', the Azure Monitor agent.")
+	flag.StringVar(&collectionRuleID, "dcr-id", "", "The resource ID of an Azure Monitor data collection rule to associate with the VM, once the 'ama' extension is installed.")
+	flag.Var(&extensionTypes, "extension", "An extension to install on the VM once it has been created, as with -extension-type. May be repeated to install several extensions, one after another, in the order given.")
+	flag.BoolVar(&skipExtension, "skip-extension", false, "Stop once the VM has been created, without installing any extension on it.")
+	flag.StringVar(&adminUsername, "admin-username", "sampleuser", "The name of the administrator account created on the VM.")
+	flag.StringVar(&accessUsername, "vmaccess-username", "sampleuser", "The user whose credentials the VMAccess extension resets. If the user doesn't exist, it is created.")
+	flag.StringVar(&accessPassword, "vmaccess-password", "", "The new password the VMAccess extension gives the user.")
+	flag.StringVar(&accessKeyFile, "vmaccess-ssh-key-file", "", "A public SSH key the VMAccess extension authorizes for the user. Only supported with -os linux.")
+	flag.StringVar(&settingsFile, "extension-settings-file", "", "A JSON file holding an object to use as the public settings of the extension chosen with -extension-type, in place of the settings this sample would otherwise provide.")
+	flag.StringVar(&protectedFile, "extension-protected-settings-file", "", "A JSON file holding an object to use as the protected settings of the extension chosen with -extension-type, in place of the settings this sample would otherwise provide.")
+	flag.StringVar(&handlerVersion, "handler-version", "", "The handler version, of the form major.minor, of the extension chosen with -extension-type. By default, a version known to work with this sample is used.")
+	flag.BoolVar(&autoUpgradeMinor, "auto-upgrade-minor-version", true, "Allow Azure to upgrade the installed extensions to newer minor versions of their handlers. Disable to pin exact handler versions.")
+	flag.StringVar(&exportTemplate, "export-template", "", "Instead of creating any assets, write an equivalent Azure Resource Manager template to this file.")
+	flag.StringVar(&osType, "os", "linux", "The operating system of the VM that is created. Either 'linux' or 'windows'.")
+	flag.StringVar(&unattendFile, "unattend-content", "", "A file holding an unattend.xml snippet to be applied while provisioning a Windows VM.")
+	flag.StringVar(&unattendPass, "unattend-pass", string(compute.OobeSystem), "The Windows setup pass that -unattend-content applies to.")
+	flag.StringVar(&unattendComp, "unattend-component", string(compute.MicrosoftWindowsShellSetup), "The Windows setup component that -unattend-content applies to.")
+	flag.StringVar(&unattendSetting, "unattend-setting", "", "The setting that -unattend-content provides. Either 'AutoLogon' or 'FirstLogonCommands'.")
+	flag.StringVar(&timeZone, "time-zone", "", "The time zone of a Windows VM's clock, as a Windows time zone ID like 'Pacific Standard Time'. Defaults to UTC.")
+	flag.StringVar(&secretsVault, "secrets-vault-id", "", "The resource ID of a Key Vault holding certificates to install on the VM while it's provisioned. The vault must be enabled for deployment, and in the VM's region.")
+	flag.Var(&resourceTagSets, "tag", "A tag, of the form key=value, to give every resource this sample creates. Prefix it with a kind of resource, as in vm:key=value, to give it only to resources of that kind, overriding any tag of the same key given to all. The kinds are: "+strings.Join(tagKinds, ", ")+". May be repeated.")
+	flag.Var(&certificateURLs, "certificate-url", "The versioned URL of a certificate, stored as a secret in the vault given by -secrets-vault-id, to install on the VM. May be repeated.")
+	flag.StringVar(&certificateStore, "certificate-store", "My", "The certificate store of the LocalMachine account that -certificate-url installs into, on Windows VMs.")
+	flag.StringVar(&computerName, "computer-name", "", "The host name of the VM's operating system. By default, one is derived from the VM's resource name.")
+	flag.StringVar(&cloudInitFile, "cloud-init-file", "", "A local cloud-init configuration to provide to a Linux VM as custom data when it first boots.")
+	flag.BoolVar(&reportHostKeys, "report-host-keys", false, "Once the VM has been created, use the CustomScript extension to look up the fingerprints of its SSH host keys, and log them so they can be trusted ahead of connecting.")
+	flag.StringVar(&sshKeyOut, "ssh-private-key-out", "", "Generate an SSH key pair, authorize its public key for the VM's administrator, and write its private key to this file. Only supported with -os linux.")
+	flag.BoolVar(&forceOverwrite, "force", false, "Overwrite the file named by -ssh-private-key-out if it already exists.")
+	flag.StringVar(&scriptFile, "script-file", "", "A local script to run on the VM through the CustomScript extension once it has been created.")
+	flag.StringVar(&licenseType, "license-type", "", "The license the VM's OS is already covered by, to apply Azure Hybrid Benefit. One of 'Windows_Server', 'Windows_Client', 'RHEL_BYOS', or 'SLES_BYOS', and it must suit the image chosen by -os.")
+	flag.StringVar(&osDiskCaching, "os-disk-caching", string(compute.ReadWrite), "The host caching mode of the VM's OS disk. Either 'None', 'ReadOnly', or 'ReadWrite'.")
+	flag.StringVar(&osDiskName, "os-disk-name", "", "The name of the VM's OS disk. By default, Azure chooses one.")
+	flag.StringVar(&dataDiskName, "data-disk-name", "", "The name of the data disk attached to the VM. By default, a unique name is generated.")
+	flag.StringVar(&sourceSnapshot, "source-snapshot-id", "", "The resource ID of a snapshot of an OS disk. The VM's OS disk is copied from it, instead of being created from a marketplace image, and keeps the operating system configuration the snapshot was taken with.")
+	flag.IntVar(&nicCount, "nic-count", 1, "The number of network interfaces to attach to the VM. Only the first, primary, interface is given a Public IP Address.")
+	flag.BoolVar(&ipForwarding, "ip-forwarding", false, "Enable IP forwarding on the VM's network interfaces, so that it can route traffic addressed to other hosts, as a network virtual appliance does. The VM's operating system must be configured to forward it too.")
+	flag.BoolVar(&noPublicIP, "no-public-ip", false, "Create the VM without any Public IP Address, so that it is only reachable from within its Virtual Network.")
+	flag.BoolVar(&createNSG, "nsg", false, "Create a Network Security Group to filter the VM's network traffic.")
+	flag.StringVar(&existingVNet, "vnet-name", "", "The name of an existing Virtual Network to put the VM in, instead of creating one. Requires -subnet-name.")
+	flag.StringVar(&existingSubnet, "subnet-name", "", "The name of the subnet of -vnet-name to put the VM in.")
+	flag.StringVar(&vnetGroup, "vnet-resource-group", "", "The Resource Group that holds -vnet-name. Defaults to -resource-group.")
+	flag.StringVar(&nsgScope, "nsg-scope", nsgScopeNIC, "Where the Network Security Group created through -nsg is associated. Either 'nic', for each of the VM's network interfaces, or 'subnet', for the subnet the VM is in.")
+	flag.BoolVar(&flowLogs, "flow-logs", false, "Have Network Watcher log the traffic flowing through the Network Security Group created with -nsg to the sample's Storage Account.")
+	flag.StringVar(&dnsLabel, "dns-label", "", "A domain name label for the Public IP Address that is created, so that the VM is reachable at {label}.{location}.cloudapp.azure.com.")
+	flag.StringVar(&publicIPID, "public-ip-id", "", "The resource ID of an existing Public IP Address to assign to the VM, instead of creating one.")
+	flag.StringVar(&lbBackendPoolID, "lb-backend-pool-id", "", "The resource ID of an existing Load Balancer backend address pool that the VM's network interface should join.")
 	flag.Parse()
 
 	ensureUUID := func(name, raw string) uuid.UUID {
@@ -286,509 +1254,4658 @@ func init() {
 		if parsed, err := uuid.FromString(raw); err == nil {
 			retval = parsed
 		} else {
-			errLog.Printf("'%s' doesn't look like an Azure %s. This sample expects a uuid.", raw, name)
-			badArgs = true
+			problems = append(problems, fmt.Errorf("'%s' doesn't look like an Azure %s. This sample expects a uuid", raw, name))
 		}
 		return retval
 	}
 
-	// userSubscriptionID = ensureUUID("Subscription ID", *unformattedSubscriptionID)
-	// userTenantID = ensureUUID("Tenant ID", *unformattedTenantID)
-	userClientID = ensureUUID("Client ID", "04b07795-8ddb-461a-bbee-02f9e1bf7b46") // This is the client ID for the Azure CLI. It was chosen for its public well-known status.
+	userClientID = ensureUUID("Client ID", *unformattedClientID)
 
-	var debugWriter io.Writer
-	if *printDebug {
-		debugWriter = os.Stdout
-	} else {
-		debugWriter = ioutil.Discard
+	if lbBackendPoolID != "" && !lbBackendPoolPattern.MatchString(lbBackendPoolID) {
+		problems = append(problems, fmt.Errorf("'%s' doesn't look like an Azure Load Balancer backend address pool ID. This sample expects an ID of the form /subscriptions/{subscription}/resourceGroups/{group}/providers/Microsoft.Network/loadBalancers/{loadBalancer}/backendAddressPools/{pool}", lbBackendPoolID))
 	}
-	debugLog = log.New(debugWriter, "[DEBUG] ", 0)
 
-	if badArgs {
-		os.Exit(1)
+	osType = strings.ToLower(osType)
+	if osType != osLinux && osType != osWindows {
+		problems = append(problems, fmt.Errorf("'%s' is not a supported operating system. This sample expects '%s' or '%s'", osType, osLinux, osWindows))
 	}
-}
 
-func setupResourceGroup(subscriptionID uuid.UUID, authorizer autorest.Authorizer) (created resources.Group, deleter func() <-chan error, err error) {
-	resourceClient := resources.NewGroupsClient(subscriptionID.String())
-	resourceClient.Authorizer = authorizer
+	if unattendFile != "" {
+		if contents, err := readUnattendContent(); err != nil {
+			problems = append(problems, err)
+		} else {
+			unattendContent = contents
+		}
+	} else if unattendSetting != "" {
+		problems = append(problems, errors.New("-unattend-setting is only meaningful alongside -unattend-content"))
+	}
 
-	name := fmt.Sprintf("sample-rg%s", uuid.NewV4().String())
+	if timeZone != "" {
+		if osType != osWindows {
+			problems = append(problems, errors.New("-time-zone may only be used with -os windows"))
+		} else if known, ok := windowsTimeZone(timeZone); ok {
+			timeZone = known
+		} else {
+			problems = append(problems, fmt.Errorf("'%s' is not a Windows time zone ID. Run `tzutil /l` on Windows to see the IDs, like 'Pacific Standard Time'", timeZone))
+		}
+	}
 
-	created, err = resourceClient.CreateOrUpdate(name, resources.Group{
-		Location: to.StringPtr(location),
-	})
+	for _, kind := range tagKinds {
+		if tags := resourceTags(kind); tags != nil && len(*tags) > maxTags {
+			problems = append(problems, fmt.Errorf("resources of kind '%s' would be given %d tags, but may have at most %d", kind, len(*tags), maxTags))
+		}
+	}
 
-	if err == nil {
-		deleter = func() <-chan error {
-			_, result := resourceClient.Delete(*created.Name, nil)
-			return result
+	if (secretsVault == "") != (len(certificateURLs) == 0) {
+		problems = append(problems, errors.New("-secrets-vault-id and -certificate-url identify the certificates to install together, so each requires the other"))
+	}
+	if secretsVault != "" {
+		if matches := vaultPattern.FindStringSubmatch(secretsVault); matches == nil {
+			problems = append(problems, fmt.Errorf("'%s' is not a Key Vault ID. This sample expects an ID of the form /subscriptions/{subscription}/resourceGroups/{group}/providers/Microsoft.KeyVault/vaults/{name}", secretsVault))
+		} else {
+			for _, certificate := range certificateURLs {
+				if vaultName, _ := parseCertificateURL(certificate); !strings.EqualFold(vaultName, matches[3]) {
+					problems = append(problems, fmt.Errorf("certificate '%s' is stored in vault '%s', not '%s', which -secrets-vault-id names", certificate, vaultName, matches[3]))
+				}
+			}
 		}
-	} else {
-		deleter = func() <-chan error {
-			result := make(chan error)
-			close(result)
-			return result
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "certificate-store" && osType != osWindows {
+			problems = append(problems, errors.New("-certificate-store may only be used with -os windows. Linux VMs receive their certificates in /var/lib/waagent"))
 		}
+	})
+
+	if reportHostKeys && (osType != osLinux || noPublicIP) {
+		problems = append(problems, errors.New("-report-host-keys relies on the Linux CustomScript extension and is only useful with a Public IP Address, so it requires -os linux and can't be used with -no-public-ip"))
 	}
 
-	return
-}
+	if scriptFile != "" && osType != osLinux {
+		problems = append(problems, errors.New("-script-file relies on the Linux CustomScript extension, and may only be used with -os linux"))
+	}
 
-// setupKeyVault creates a secure location to hold the secrets for encrypting and unencrypting the VM created in this sample's OS and Data disks.
-func setupKeyVault(userID, subscriptionID, tenantID uuid.UUID, group resources.Group, authorizer autorest.Authorizer) (<-chan keyvault.Vault, <-chan error) {
-	results, errs := make(chan keyvault.Vault, 1), make(chan error, 1)
+	if sshKeyOut != "" {
+		if osType != osLinux {
+			problems = append(problems, errors.New("-ssh-private-key-out may only be used with -os linux"))
+		}
+		if exportTemplate != "" {
+			problems = append(problems, errors.New("-ssh-private-key-out generates a key while the VM is created, so it can't be used with -export-template"))
+		}
+		if _, err := os.Stat(sshKeyOut); err == nil && !forceOverwrite {
+			problems = append(problems, fmt.Errorf("'%s' already exists. Use -force to overwrite it with the generated private key", sshKeyOut))
+		}
+	} else if forceOverwrite {
+		problems = append(problems, errors.New("-force only allows -ssh-private-key-out to overwrite an existing file, so it requires it"))
+	}
 
-	go func() {
-		var err error
-		var created keyvault.Vault
+	if cloudInitFile != "" {
+		if contents, err := ioutil.ReadFile(cloudInitFile); err != nil {
+			problems = append(problems, fmt.Errorf("could not read cloud-init file '%s'. Error: %v", cloudInitFile, err))
+		} else if len(contents) == 0 {
+			problems = append(problems, fmt.Errorf("cloud-init file '%s' is empty", cloudInitFile))
+		} else if len(contents) > maxCustomDataLength {
+			problems = append(problems, fmt.Errorf("cloud-init file '%s' is %d bytes, but Azure accepts at most %d bytes of custom data", cloudInitFile, len(contents), maxCustomDataLength))
+		} else if osType != osLinux {
+			problems = append(problems, errors.New("-cloud-init-file may only be used with -os linux"))
+		} else {
+			cloudInitContent = contents
+		}
+	}
 
-		defer close(results)
-		defer close(errs)
+	if computerName != "" {
+		if err := validateComputerName(computerName); err != nil {
+			problems = append(problems, err)
+		}
+	}
 
-		client := keyvault.NewVaultsClient(subscriptionID.String())
-		client.Authorizer = authorizer
+	if scriptFile != "" {
+		if contents, err := ioutil.ReadFile(scriptFile); err != nil {
+			problems = append(problems, fmt.Errorf("could not read script file '%s'. Error: %v", scriptFile, err))
+		} else if len(strings.TrimSpace(string(contents))) == 0 {
+			problems = append(problems, fmt.Errorf("script file '%s' is empty", scriptFile))
+		} else {
+			scriptContent = contents
+		}
+	}
 
-		vaultName := uuid.NewV4().String()
-		vaultName = strings.Replace(vaultName, "-", "", -1)
-		vaultName = "vault-" + vaultName
-		vaultName = vaultName[:24]
+	if publicIPID != "" && !publicIPPattern.MatchString(publicIPID) {
+		problems = append(problems, fmt.Errorf("'%s' doesn't look like an Azure Public IP Address ID. This sample expects an ID of the form /subscriptions/{subscription}/resourceGroups/{group}/providers/Microsoft.Network/publicIPAddresses/{name}", publicIPID))
+	}
 
-		created, err = client.CreateOrUpdate(*group.Name, vaultName, keyvault.VaultCreateOrUpdateParameters{
-			Location: group.Location,
-			Properties: &keyvault.VaultProperties{
-				AccessPolicies: &[]keyvault.AccessPolicyEntry{
-					{
-						ObjectID: to.StringPtr(userID.String()),
-						TenantID: &tenantID,
-						Permissions: &keyvault.Permissions{
-							Keys:    &[]keyvault.KeyPermissions{keyvault.KeyPermissionsAll},
-							Secrets: &[]keyvault.SecretPermissions{keyvault.SecretPermissionsAll},
-						},
-					},
-					{
-						ObjectID: to.StringPtr(servicePrincipalObjectID), // The ObjectID of the Service Principal (not the application around it) that will be used programmatically by the extension
-						TenantID: &tenantID,
-						Permissions: &keyvault.Permissions{
-							Keys:    &[]keyvault.KeyPermissions{keyvault.KeyPermissionsAll},
-							Secrets: &[]keyvault.SecretPermissions{keyvault.SecretPermissionsAll},
-						},
-					},
-				},
-				EnabledForDiskEncryption: to.BoolPtr(true),
-				Sku: &keyvault.Sku{
-					Family: to.StringPtr("A"),
-					Name:   keyvault.Standard,
-				},
-				TenantID: &tenantID,
-			},
-		})
+	if noPublicIP && publicIPID != "" {
+		problems = append(problems, errors.New("-no-public-ip and -public-ip-id can't be used together"))
+	}
 
-		if err != nil {
-			errs <- err
-			return
+	nsgScope = strings.ToLower(nsgScope)
+	if nsgScope != nsgScopeNIC && nsgScope != nsgScopeSubnet {
+		problems = append(problems, fmt.Errorf("'%s' is not a supported Network Security Group scope. This sample expects '%s' or '%s'", nsgScope, nsgScopeNIC, nsgScopeSubnet))
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "nsg-scope" && !createNSG {
+			problems = append(problems, errors.New("-nsg-scope is only meaningful alongside -nsg"))
 		}
+	})
 
-		results <- created
-	}()
-
-	return results, errs
-}
-
-func setupEncryptionKey(clientID, tenantID uuid.UUID, authorizer autorest.Authorizer, vault keyvault.Vault) (key keys.KeyBundle, err error) {
-	client := keys.New()
-	client.Authorizer = authorizer
+	// Each of these modes acts on the existing VM named by -vm-name, instead of creating any assets.
+	existingVMModes := []struct {
+		name    string
+		purpose string
+		chosen  bool
+	}{
+		{"restart-vm", "restart", restartVM},
+		{"list-extensions", "list the extensions of", listExtensions},
+		{"reapply-vm", "reapply", reapplyVM},
+		{"compare-extension", "compare the extensions of", compareExt},
+	}
+	var chosenModes []string
+	for _, mode := range existingVMModes {
+		if !mode.chosen {
+			continue
+		}
+		chosenModes = append(chosenModes, "-"+mode.name)
+		if existingGroup == "" || existingVM == "" {
+			problems = append(problems, fmt.Errorf("-%s requires both -resource-group and -vm-name, to identify the VM to %s", mode.name, mode.purpose))
+		}
+		if exportTemplate != "" {
+			problems = append(problems, fmt.Errorf("-%s acts on an existing VM, and can't be used with -export-template", mode.name))
+		}
+	}
+	if len(chosenModes) > 1 {
+		problems = append(problems, fmt.Errorf("%s are separate modes, so only one may be used at a time", strings.Join(chosenModes, " and ")))
+	} else if existingVM != "" && len(chosenModes) == 0 {
+		problems = append(problems, errors.New("-vm-name only identifies an existing VM, so it requires -restart-vm, -list-extensions, -reapply-vm, or -compare-extension"))
+	}
+	if withStatus && !listExtensions {
+		problems = append(problems, errors.New("-with-status only changes the output of -list-extensions, so it requires it"))
+	}
 
-	keyName := "key-" + uuid.NewV4().String()
+	if listTenants && (len(chosenModes) > 0 || listSizes || exportTemplate != "") {
+		problems = append(problems, errors.New("-tenant-discovery only signs in and lists tenants, so it can't be used with -restart-vm, -list-extensions, -reapply-vm, -compare-extension, -list-sizes, or -export-template"))
+	}
 
-	key, err = client.CreateKey(vaultURL(vault), keyName, keys.KeyCreateParameters{
-		KeyAttributes: &keys.KeyAttributes{
-			Enabled: to.BoolPtr(true),
-		},
-		KeySize: to.Int32Ptr(2048), // As of writing this sample, 2048 is the only supported KeySize.
-		KeyOps: &[]keys.JSONWebKeyOperation{
-			keys.Encrypt,
-			keys.Decrypt,
-		},
-		Kty: keys.RSA,
-	})
+	if forceDelete && len(chosenModes) > 0 {
+		problems = append(problems, fmt.Errorf("-force-delete only applies when the sample deletes the Resource Group it created, so it can't be used with %s", strings.Join(chosenModes, " or ")))
+	} else if forceDelete && existingGroup != "" {
+		problems = append(problems, errors.New("-force-delete only applies when the sample deletes the Resource Group it created, so it can't be used with -resource-group"))
+	}
+	if ipForwarding && len(chosenModes) > 0 {
+		problems = append(problems, fmt.Errorf("-ip-forwarding configures the network interfaces this sample creates, so it can't be used with %s", strings.Join(chosenModes, " or ")))
+	} else if ipForwarding && noPublicIP && nicCount == 1 && existingSubnet == "" {
+		warnLog.Print("With -no-public-ip and a single network interface in a Virtual Network of its own, the VM has no other hosts to forward traffic for. -ip-forwarding is more useful with -nic-count, or with -vnet-name and -subnet-name.")
+	}
 
-	return
-}
+	if forceDelete && noCleanup {
+		problems = append(problems, fmt.Errorf("-force-delete only applies when the sample deletes the Resource Group it created, so it can't be used with -no-cleanup or %s", noCleanupEnv))
+	}
 
-func setupManagedDisk(clientID, subscriptionID, tenantID uuid.UUID, group resources.Group, account storage.Account, vault keyvault.Vault, authorizer, vaultAuthorizer autorest.Authorizer) (<-chan disk.Model, <-chan error) {
-	results, errs := make(chan disk.Model, 1), make(chan error, 1)
-	go func() {
-		var err error
-		var created disk.Model
-		defer close(results)
-		defer close(errs)
+	if sourceSnapshot != "" {
+		if !snapshotPattern.MatchString(sourceSnapshot) {
+			problems = append(problems, fmt.Errorf("'%s' is not a snapshot ID. This sample expects an ID of the form /subscriptions/{subscription}/resourceGroups/{group}/providers/Microsoft.Compute/snapshots/{name}", sourceSnapshot))
+		}
+		// An OS disk that's attached, rather than created from an image, isn't provisioned again, so there's no OS profile to apply these to.
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "admin-username", "computer-name", "cloud-init-file", "unattend-content", "unattend-pass", "unattend-component", "unattend-setting", "time-zone",
+				"secrets-vault-id", "certificate-url", "certificate-store", "ssh-private-key-out":
+				problems = append(problems, fmt.Errorf("-%s configures a newly provisioned operating system, so it can't be used with -source-snapshot-id", f.Name))
+			}
+		})
+	}
 
-		diskClient := disk.NewDisksClient(subscriptionID.String())
-		diskClient.Authorizer = authorizer
+	if (existingVNet == "") != (existingSubnet == "") {
+		problems = append(problems, errors.New("-vnet-name and -subnet-name identify an existing subnet together, so each requires the other"))
+	}
+	if existingVNet != "" {
+		if vnetGroup == "" {
+			vnetGroup = existingGroup
+		}
+		if vnetGroup == "" {
+			problems = append(problems, errors.New("-vnet-name requires -vnet-resource-group, or -resource-group, to find it in. The Resource Group this sample creates has no Virtual Networks yet"))
+		}
+		if createNSG && nsgScope == nsgScopeSubnet {
+			problems = append(problems, errors.New("-nsg-scope subnet would change the existing subnet chosen with -subnet-name. Use -nsg-scope nic instead"))
+		}
+	} else if vnetGroup != "" {
+		problems = append(problems, errors.New("-vnet-resource-group only locates -vnet-name, so it requires -vnet-name"))
+	}
 
-		diskName := "disk-" + uuid.NewV4().String()
+	if flowLogs && !createNSG {
+		problems = append(problems, errors.New("-flow-logs only applies to a Network Security Group created by this sample, so it requires -nsg"))
+	}
+	if flowLogs && exportTemplate != "" {
+		problems = append(problems, errors.New("-flow-logs are configured through Network Watcher, and can't be described by -export-template"))
+	}
 
-		_, diskErrs := diskClient.CreateOrUpdate(*group.Name, diskName, disk.Model{
-			Location: group.Location,
-			Properties: &disk.Properties{
-				CreationData: &disk.CreationData{
-					CreateOption: disk.Empty,
-				},
-				DiskSizeGB: to.Int32Ptr(64),
-			},
-		}, nil)
-		if err = <-diskErrs; err != nil {
-			errs <- err
-			return
+	if dnsLabel != "" {
+		if !dnsLabelPattern.MatchString(dnsLabel) {
+			problems = append(problems, fmt.Errorf("'%s' is not a valid DNS label. Labels must be 3 to 63 lowercase letters, digits, and hyphens, starting with a letter and not ending with a hyphen", dnsLabel))
 		}
-
-		created, err = diskClient.Get(*group.Name, diskName)
-		if err != nil {
-			errs <- err
-			return
+		if noPublicIP || publicIPID != "" {
+			problems = append(problems, errors.New("-dns-label only applies to a Public IP Address created by this sample, so it can't be used with -no-public-ip or -public-ip-id"))
 		}
-		results <- created
-	}()
-	return results, errs
-}
+	}
 
-func setupVirtualMachine(clientID, subscriptionID, tenantID uuid.UUID, resourceGroup resources.Group, storageAccount storage.Account, vault keyvault.Vault, vaultAuthorizer autorest.Authorizer, dataDisk disk.Model, subnet network.Subnet, authorizer autorest.Authorizer, cancel <-chan struct{}) (created compute.VirtualMachine, err error) {
-	var networkCard network.Interface
+	switch strings.ToLower(namingScheme) {
+	case "guid":
+		naming = guidNaming{id: uuid.NewV4()}
+	case "timestamp":
+		naming = timestampNaming{started: time.Now()}
+	default:
+		problems = append(problems, fmt.Errorf("'%s' is not a supported naming scheme. This sample expects 'guid' or 'timestamp'", namingScheme))
+	}
 
-	client := compute.NewVirtualMachinesClient(subscriptionID.String())
-	client.Authorizer = authorizer
+	if naming != nil {
+		// These are the names the run uses. Network interfaces only differ by index, so the last one is the longest.
+		generated := []struct {
+			kind string
+			name string
+			rule nameRule
+		}{
+			{"Resource Group", resourceName(naming.ResourceGroupName()), resourceGroupNameRule},
+			{"Virtual Machine", resourceName(naming.VMName(0)), vmNameRule},
+			{"Network Interface", resourceName(naming.NICName(nicCount - 1)), networkNameRule},
+			{"Public IP Address", resourceName("sample-publicip"), networkNameRule},
+		}
+		if regionPairBackup {
+			generated = append(generated, generated[0])
+			generated[len(generated)-1].kind = "Disaster Recovery Resource Group"
+			generated[len(generated)-1].name += "-dr"
+		}
+		for _, current := range generated {
+			if err := current.rule.validate(current.name); err != nil {
+				problems = append(problems, fmt.Errorf("-naming, -name-prefix, and -name-suffix would produce an invalid %s name. Error: %v", current.kind, err))
+			}
+		}
+	}
 
-	vmName := fmt.Sprintf("sample-vm%s", uuid.NewV4().String())
+	for _, chosen := range [][2]string{{"os-disk-name", osDiskName}, {"data-disk-name", dataDiskName}} {
+		if chosen[1] == "" {
+			continue
+		}
+		if err := diskNameRule.validate(chosen[1]); err != nil {
+			problems = append(problems, fmt.Errorf("-%s is not a valid disk name. Error: %v", chosen[0], err))
+		}
+	}
+	if osDiskName != "" && strings.EqualFold(osDiskName, dataDiskName) {
+		problems = append(problems, errors.New("-os-disk-name and -data-disk-name must differ, since disk names are unique within a Resource Group"))
+	}
 
-	networkCard, err = setupNetworkInterface(subscriptionID, resourceGroup, subnet, network.SubResource{ID: to.StringPtr(vmName)}, authorizer)
-	if err != nil {
-		return
+	if licenseType != "" {
+		if offer, ok := licenseTypeOffers[licenseType]; !ok {
+			problems = append(problems, fmt.Errorf("'%s' is not a supported license type. This sample expects 'Windows_Server', 'Windows_Client', 'RHEL_BYOS', or 'SLES_BYOS'", licenseType))
+		} else if image := to.String(imageReference().Offer); offer != image {
+			problems = append(problems, fmt.Errorf("license type '%s' only applies to %s images, but the %s VM is created from %s", licenseType, offer, osType, image))
+		}
 	}
 
-	var storageURI *string
-	if storageAccount.PrimaryEndpoints != nil {
-		storageURI = (*storageAccount.PrimaryEndpoints).Blob
+	if caching, ok := parseCachingType(osDiskCaching); ok {
+		osDiskCaching = string(caching)
 	} else {
-		err = errors.New("No storage endpoint found")
-		return
+		problems = append(problems, fmt.Errorf("'%s' is not a supported OS disk caching mode. This sample expects '%s', '%s', or '%s'", osDiskCaching, compute.None, compute.ReadOnly, compute.ReadWrite))
 	}
-	debugLog.Print("Storage URL: ", *storageAccount.ID)
 
-	_, createErrs := client.CreateOrUpdate(*resourceGroup.Name, vmName, compute.VirtualMachine{
-		Location: resourceGroup.Location,
+	if nicCount < 1 {
+		problems = append(problems, fmt.Errorf("-nic-count must be at least 1, but was %d", nicCount))
+	} else if max, ok := maxNetworkInterfaces[compute.VirtualMachineSizeTypes(vmSize)]; ok && nicCount > max {
+		problems = append(problems, fmt.Errorf("-nic-count was %d, but VMs of size '%s' support at most %d network interfaces. Choose a larger size with -vm-size", nicCount, vmSize, max))
+	}
+
+	if settingsFile != "" {
+		if parsed, err := readJSONObject(settingsFile); err == nil {
+			settingsObject = parsed
+		} else {
+			problems = append(problems, err)
+		}
+	}
+	if protectedFile != "" {
+		if parsed, err := readJSONObject(protectedFile); err == nil {
+			protectedObject = parsed
+		} else {
+			problems = append(problems, err)
+		}
+		if exportTemplate != "" {
+			problems = append(problems, errors.New("-extension-protected-settings-file can't be used with -export-template, because the template would reveal the protected settings"))
+		}
+	}
+
+	if skipExtension {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "extension", "extension-type", "handler-version", "extension-settings-file", "extension-protected-settings-file", "dcr-id",
+				"vmaccess-username", "vmaccess-password", "vmaccess-ssh-key-file":
+				problems = append(problems, fmt.Errorf("-%s configures an extension, so it can't be used with -skip-extension", f.Name))
+			}
+		})
+		extensionTypes = nil
+	} else if len(extensionTypes) == 0 {
+		if !isSupportedExtension(extensionType) {
+			problems = append(problems, fmt.Errorf("'%s' is not a supported extension type. This sample expects one of: %s", extensionType, strings.Join(supportedExtensionTypes, ", ")))
+		}
+		extensionTypes = extensionList{extensionType}
+	} else {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "extension-type" {
+				problems = append(problems, errors.New("-extension-type and -extension can't be used together"))
+			}
+		})
+		if len(extensionTypes) > 1 && (handlerVersion != "" || settingsFile != "" || protectedFile != "") {
+			problems = append(problems, errors.New("-handler-version, -extension-settings-file, and -extension-protected-settings-file may only be used when installing a single extension"))
+		}
+	}
+
+	if extensionTypes.contains(extensionMonitorAgent) && osType == osLinux {
+		// The Linux agent supports Ubuntu from 16.04 on.
+		if image := imageReference(); to.String(image.Offer) == "UbuntuServer" && strings.HasPrefix(to.String(image.Sku), "14.") {
+			warnLog.Printf("The Azure Monitor agent doesn't support the %s %s image the VM is created from. Provisioning the 'ama' extension may fail.", to.String(image.Offer), to.String(image.Sku))
+		}
+	}
+
+	if collectionRuleID != "" {
+		if !extensionTypes.contains(extensionMonitorAgent) {
+			problems = append(problems, errors.New("-dcr-id is applied once the Azure Monitor agent is installed, so it requires the 'ama' extension"))
+		}
+		if !dataCollectionRulePattern.MatchString(collectionRuleID) {
+			problems = append(problems, fmt.Errorf("'%s' is not a data collection rule ID. This sample expects an ID of the form /subscriptions/{subscription}/resourceGroups/{group}/providers/Microsoft.Insights/dataCollectionRules/{name}", collectionRuleID))
+		}
+	}
+
+	if err := checkUsername(adminUsername); err != nil {
+		problems = append(problems, fmt.Errorf("-admin-username is not valid. Error: %v", err))
+	}
+
+	if compareExt {
+		if skipExtension {
+			problems = append(problems, errors.New("-compare-extension compares the extensions this sample would install, so it can't be used with -skip-extension"))
+		}
+		if extensionTypes.contains(extensionDiskEncryption) {
+			// Its settings name the Key Vault and key created during a run, which an existing VM's extension won't match.
+			problems = append(problems, fmt.Errorf("-compare-extension can't compare the '%s' extension, whose settings are created along with the VM", extensionDiskEncryption))
+		}
+	}
+
+	if extensionTypes.contains(extensionVMAccess) && compareExt {
+		// Only the settings are compared, and the credentials are protected settings, so only the user name is needed.
+		if err := checkUsername(accessUsername); err != nil {
+			problems = append(problems, fmt.Errorf("-vmaccess-username is not valid. Error: %v", err))
+		}
+	} else if extensionTypes.contains(extensionVMAccess) {
+		if err := readAccessCredentials(); err != nil {
+			problems = append(problems, err)
+		}
+	} else if accessPassword != "" || accessKeyFile != "" {
+		problems = append(problems, errors.New("-vmaccess-password and -vmaccess-ssh-key-file may only be used when installing the vmaccess extension"))
+	}
+
+	if handlerVersion != "" {
+		if !handlerVersionPattern.MatchString(handlerVersion) {
+			problems = append(problems, fmt.Errorf("'%s' is not a valid handler version. This sample expects a version of the form major.minor, like '1.4'", handlerVersion))
+		} else if len(extensionTypes) == 1 {
+			checkHandlerVersion()
+		}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "location" {
+			locationSet = true
+		}
+	})
+
+	// Without -location, the region of an existing Resource Group isn't known until it has been looked up.
+	if _, ok := pairedRegions[strings.ToLower(location)]; regionPairBackup && !ok && (locationSet || existingGroup == "") {
+		problems = append(problems, fmt.Errorf("'%s' has no known paired region, so -region-pair-backup can't be used with it", location))
+	}
+
+	if assumeYes && !interactive {
+		problems = append(problems, errors.New("-yes only answers the confirmation asked for by -interactive, so it can't be used without it"))
+	}
+
+	if groupLocation != "" && existingGroup != "" {
+		problems = append(problems, errors.New("-resource-group-location only applies to a Resource Group created by this sample, so it can't be used with -resource-group"))
+	}
+
+	if outputDir != "" {
+		if err := prepareOutputDir(outputDir); err == nil {
+			if summaryFile == "" {
+				summaryFile = filepath.Join(outputDir, "summary.md")
+			}
+			if eventsFile == "" {
+				eventsFile = filepath.Join(outputDir, "events.jsonl")
+			}
+		} else {
+			problems = append(problems, fmt.Errorf("could not use output directory '%s'. Error: %v", outputDir, err))
+		}
+		if protectedFile != "" {
+			warnLog.Print("template.json won't be written to -output-dir, because it would reveal -extension-protected-settings-file.")
+		}
+	}
+
+	if eventsFile == "-" {
+		events = json.NewEncoder(os.Stdout)
+	} else if eventsFile != "" {
+		if handle, err := os.Create(eventsFile); err == nil {
+			events = json.NewEncoder(handle)
+		} else {
+			problems = append(problems, fmt.Errorf("could not create events file '%s'. Error: %v", eventsFile, err))
+		}
+	}
+
+	var debugWriter io.Writer
+	if *printDebug {
+		debugWriter = os.Stdout
+	} else {
+		debugWriter = ioutil.Discard
+	}
+	debugLog = log.New(debugWriter, "[DEBUG] ", 0)
+
+	if outputDir != "" && len(problems) == 0 {
+		if logFile, err := os.Create(filepath.Join(outputDir, "run.log")); err == nil {
+			errLog.SetOutput(io.MultiWriter(os.Stderr, logFile))
+			warnLog.SetOutput(io.MultiWriter(os.Stderr, logFile))
+			statusLog.SetOutput(io.MultiWriter(os.Stdout, logFile))
+			if *printDebug {
+				debugLog.SetOutput(io.MultiWriter(os.Stdout, logFile))
+			}
+		} else {
+			problems = append(problems, fmt.Errorf("could not create log file in '%s'. Error: %v", outputDir, err))
+		}
+	}
+
+	if *unformattedSubscriptionID == "" || *unformattedTenantID == "" {
+		if subscription, tenant, name, err := loadCLIDefaults(*unformattedSubscriptionID); err == nil {
+			if *unformattedSubscriptionID == "" {
+				statusLog.Printf("Auto-selected the Azure CLI's default subscription: %s (%s)", name, subscription)
+				*unformattedSubscriptionID = subscription
+			}
+			if *unformattedTenantID == "" {
+				*unformattedTenantID = tenant
+			}
+		} else {
+			debugLog.Print("Not using Azure CLI defaults: ", err)
+		}
+	}
+
+	if *unformattedSubscriptionID != "" {
+		userSubscriptionID = ensureUUID("Subscription ID", *unformattedSubscriptionID)
+	}
+	if *unformattedTenantID != "" {
+		userTenantID = ensureUUID("Tenant ID", *unformattedTenantID)
+	}
+
+	if pollInterval < minPollInterval || pollInterval > maxPollInterval {
+		problems = append(problems, fmt.Errorf("'%v' is not a valid polling interval. This sample expects a duration between %v and %v", pollInterval, minPollInterval, maxPollInterval))
+	}
+
+	if extensionTimeout < 0 {
+		problems = append(problems, fmt.Errorf("'%v' is not a valid extension timeout", extensionTimeout))
+	}
+	if bootTimeout < 0 {
+		problems = append(problems, fmt.Errorf("'%v' is not a valid boot timeout", bootTimeout))
+	}
+
+	if requestTimeout < 0 {
+		problems = append(problems, fmt.Errorf("'%v' is not a valid request timeout", requestTimeout))
+	} else {
+		sender = newHTTPClient(requestTimeout)
+		if recordDir != "" {
+			if err := os.MkdirAll(recordDir, 0700); err == nil {
+				sender = autorest.DecorateSender(sender, withRecording(recordDir))
+			} else {
+				problems = append(problems, fmt.Errorf("could not create recording directory '%s'. Error: %v", recordDir, err))
+			}
+		}
+		sender = autorest.DecorateSender(sender, withCorrelationID(correlationID))
+	}
+
+	if maxRPS < 0 {
+		problems = append(problems, fmt.Errorf("'%v' is not a valid request rate. Use a positive number of requests per second, or 0 to disable throttling", maxRPS))
+	} else if maxRPS > 0 {
+		sender = autorest.DecorateSender(sender, withRateLimit(newRateLimiter(maxRPS)))
+	}
+
+	if len(problems) > 0 {
+		// Report every problem at once, so they can all be fixed before trying again.
+		errLog.Printf("Found %d problem(s) with the arguments given:", len(problems))
+		for i, problem := range problems {
+			errLog.Printf("  %d. %v", i+1, problem)
+		}
+		os.Exit(1)
+	}
+}
+
+// printVMSizes writes a table describing each of the VM sizes available in a region.
+func printVMSizes(subscriptionID uuid.UUID, location string, authorizer autorest.Authorizer) error {
+	client := compute.NewVirtualMachineSizesClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	sizes, err := client.List(location)
+	if err != nil {
+		return err
+	}
+	if sizes.Value == nil || len(*sizes.Value) == 0 {
+		return fmt.Errorf("no VM sizes are available in '%s'", location)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tVCPUS\tMEMORY (GiB)\tMAX DATA DISKS")
+	for _, size := range *sizes.Value {
+		fmt.Fprintf(table, "%s\t%d\t%.1f\t%d\n", to.String(size.Name), to.Int32(size.NumberOfCores), float64(to.Int32(size.MemoryInMB))/1024, to.Int32(size.MaxDataDiskCount))
+	}
+	return table.Flush()
+}
+
+// confirmPlan describes the assets this run is about to create, then asks whether to go ahead. When there's nobody to ask, because stdin
+// isn't a terminal or -yes was given, it goes ahead without asking.
+func confirmPlan(subscriptionID uuid.UUID) (proceed bool, err error) {
+	var groupDescription string
+	if existingGroup != "" {
+		groupDescription = existingGroup + " (existing, left in place)"
+	} else {
+		groupDescription = "new, deleted when the sample finishes"
+		if noCleanup {
+			groupDescription = "new, left in place"
+		} else if keepOnError {
+			groupDescription += " unless it fails"
+		}
+		if forceDelete {
+			groupDescription += ", with its VM force deleted"
+		}
+	}
+
+	var address string
+	switch {
+	case noPublicIP:
+		address = "none"
+	case publicIPID != "":
+		address = publicIPID + " (existing)"
+	case dnsLabel != "":
+		address = "new, with DNS label " + dnsLabel
+	default:
+		address = "new"
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "This run will create:")
+	fmt.Fprintf(table, "  Subscription:\t%s\n", subscriptionID)
+	fmt.Fprintf(table, "  Location:\t%s\n", location)
+	fmt.Fprintf(table, "  Resource Group:\t%s\n", groupDescription)
+	fmt.Fprintf(table, "  Virtual Machine:\t%s, %s\n", vmSize, osType)
+	if sourceSnapshot != "" {
+		fmt.Fprintln(table, "  OS Disk:\tcopied from "+sourceSnapshot)
+	}
+	if ipForwarding {
+		fmt.Fprintf(table, "  Network Interfaces:\t%d, with IP forwarding\n", nicCount)
+	} else {
+		fmt.Fprintf(table, "  Network Interfaces:\t%d\n", nicCount)
+	}
+	fmt.Fprintf(table, "  Public IP Address:\t%s\n", address)
+	if createNSG {
+		fmt.Fprintf(table, "  Network Security Group:\tapplied to the %s\n", nsgScope)
+	}
+	fmt.Fprintln(table, "  Virtual Network, Storage Account, Key Vault, Managed Disk:\tone of each")
+	if skipExtension {
+		fmt.Fprintln(table, "  Extensions:\tnone")
+	} else {
+		fmt.Fprintf(table, "  Extensions:\t%s\n", extensionTypes.String())
+	}
+	if scriptContent != nil {
+		fmt.Fprintln(table, "  Custom Script:\t"+scriptFile)
+	}
+	if regionPairBackup {
+		fmt.Fprintln(table, "  Disaster Recovery Resource Group:\tin the paired region")
+	}
+	if err = table.Flush(); err != nil {
+		return
+	}
+
+	if assumeYes {
+		return true, nil
+	}
+	if !isTerminal(os.Stdin) {
+		warnLog.Print("stdin is not a terminal, so proceeding without confirmation.")
+		return true, nil
+	}
+
+	fmt.Print("proceed? [y/N] ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// prepareOutputDir creates dir if it doesn't exist yet, and ensures that files can be written to it.
+func prepareOutputDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	probe, err := ioutil.TempFile(dir, ".probe")
+	if err != nil {
+		return fmt.Errorf("it isn't writable: %v", err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// ensureQuota checks that enough regional vCPU quota remains in a subscription to create a VM of the given size, so that a shortfall is
+// reported before any assets are created instead of when the VM itself is.
+func ensureQuota(subscriptionID uuid.UUID, location, size string, authorizer autorest.Authorizer) error {
+	sizeClient := compute.NewVirtualMachineSizesClient(subscriptionID.String())
+	sizeClient.Authorizer = authorizer
+	sizeClient.Sender = sender
+	sizeClient.PollingDelay = pollInterval
+
+	sizes, err := sizeClient.List(location)
+	if err != nil {
+		return err
+	}
+
+	var cores int64 = -1
+	if sizes.Value != nil {
+		for _, candidate := range *sizes.Value {
+			if strings.EqualFold(to.String(candidate.Name), size) {
+				cores = int64(to.Int32(candidate.NumberOfCores))
+				break
+			}
+		}
+	}
+	if cores < 0 {
+		return fmt.Errorf("VM size '%s' isn't available in '%s'. Use -list-sizes to see the sizes that are", size, location)
+	}
+
+	usageClient := compute.NewUsageClient(subscriptionID.String())
+	usageClient.Authorizer = authorizer
+	usageClient.Sender = sender
+	usageClient.PollingDelay = pollInterval
+
+	usages, err := usageClient.List(location)
+	if err != nil {
+		return err
+	}
+
+	for usages.Value != nil {
+		for _, usage := range *usages.Value {
+			if usage.Name == nil || to.String(usage.Name.Value) != "cores" {
+				continue
+			}
+			remaining := to.Int64(usage.Limit) - int64(to.Int32(usage.CurrentValue))
+			debugLog.Printf("Regional vCPU Quota: %d of %d used", to.Int32(usage.CurrentValue), to.Int64(usage.Limit))
+			if remaining < cores {
+				return fmt.Errorf("insufficient quota: need %d cores, have %d in '%s'", cores, remaining, location)
+			}
+			return nil
+		}
+
+		if usages.NextLink == nil {
+			break
+		}
+		usages, err = usageClient.ListNextResults(usages)
+		if err != nil {
+			return err
+		}
+	}
+
+	debugLog.Print("No regional vCPU quota reported for ", location)
+	return nil
+}
+
+// registerProviders ensures that each of the given resource provider namespaces is registered with a subscription, waiting for any
+// pending registrations to complete.
+func registerProviders(subscriptionID uuid.UUID, authorizer autorest.Authorizer, namespaces ...string) error {
+	const maxWait = 10 * time.Minute
+
+	client := resources.NewProvidersClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	for _, namespace := range namespaces {
+		provider, err := client.Get(namespace, "")
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(to.String(provider.RegistrationState), "Registered") {
+			debugLog.Print("Resource Provider Already Registered: ", namespace)
+			continue
+		}
+
+		statusLog.Print("Registering Resource Provider: ", namespace)
+		provider, err = client.Register(namespace)
+		if err != nil {
+			return err
+		}
+
+		for start := time.Now(); !strings.EqualFold(to.String(provider.RegistrationState), "Registered"); {
+			if time.Since(start) > maxWait {
+				return fmt.Errorf("timed out waiting for resource provider '%s' to be registered (state: %s)", namespace, to.String(provider.RegistrationState))
+			}
+			debugLog.Printf("Resource Provider %s Registration State: %s", namespace, to.String(provider.RegistrationState))
+			time.Sleep(pollInterval)
+			provider, err = client.Get(namespace, "")
+			if err != nil {
+				return err
+			}
+		}
+		statusLog.Print("Registered Resource Provider: ", namespace)
+	}
+	return nil
+}
+
+// withRetry calls op until it stops failing with an error that isRetryable, it has been attempted a handful of times, or a short window
+// passes. Azure Resource Manager is eventually consistent, so a resource that was just created may briefly not be found, or may still be
+// busy with another operation.
+func withRetry(op func() error) (err error) {
+	const maxAttempts = 5
+	const window = 30 * time.Second
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err = op()
+		if !isRetryable(err) || attempt >= maxAttempts || time.Since(start) > window {
+			return
+		}
+		debugLog.Printf("Retrying after attempt %d of %d failed: %v", attempt, maxAttempts, err)
+		time.Sleep(pollInterval)
+	}
+}
+
+// lifecycleEvent is written to -events-jsonl as each step of the sample starts and finishes.
+type lifecycleEvent struct {
+	Time     time.Time `json:"time"`
+	Step     string    `json:"step"`
+	Status   string    `json:"status"`
+	Duration float64   `json:"durationSeconds,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// events encodes lifecycle events to the destination chosen with -events-jsonl, if any. Steps may run in parallel, so writes are
+// serialized through eventsLock.
+var (
+	events     *json.Encoder
+	eventsLock sync.Mutex
+)
+
+// beginStep records that the named step of the sample has started. The returned func records that it finished, successfully if it is
+// passed a nil error, and returns that error unchanged so that it can wrap the step's result.
+func beginStep(name string) (finish func(error) error) {
+	start := time.Now()
+	emitEvent(lifecycleEvent{Time: start, Step: name, Status: "started"})
+
+	return func(err error) error {
+		finished := lifecycleEvent{
+			Time:     time.Now(),
+			Step:     name,
+			Status:   "succeeded",
+			Duration: time.Since(start).Seconds(),
+		}
+		if err != nil {
+			finished.Status = "failed"
+			finished.Error = err.Error()
+		}
+		emitEvent(finished)
+		summary.addStep(finished)
+		return err
+	}
+}
+
+func emitEvent(event lifecycleEvent) {
+	if events == nil {
+		return
+	}
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	if err := events.Encode(event); err != nil {
+		debugLog.Print("could not write lifecycle event: ", err)
+	}
+}
+
+// runSummary collects the outcome of a run, to be reported through -summary-file. Steps may run in parallel, so it is locked while
+// being updated.
+type runSummary struct {
+	sync.Mutex
+	resources  []string
+	extensions []string
+	steps      []lifecycleEvent
+	address    string
+	fqdn       string
+	hostKeys   []string
+}
+
+var summary runSummary
+
+func (report *runSummary) addResource(kind, name string) {
+	report.Lock()
+	defer report.Unlock()
+	report.resources = append(report.resources, fmt.Sprintf("%s: `%s`", kind, name))
+}
+
+func (report *runSummary) addExtension(extension compute.VirtualMachineExtension) {
+	report.Lock()
+	defer report.Unlock()
+	var state string
+	if extension.VirtualMachineExtensionProperties != nil {
+		state = to.String(extension.ProvisioningState)
+	}
+	report.extensions = append(report.extensions, fmt.Sprintf("`%s`: %s", to.String(extension.Name), state))
+}
+
+func (report *runSummary) addStep(finished lifecycleEvent) {
+	report.Lock()
+	defer report.Unlock()
+	report.steps = append(report.steps, finished)
+}
+
+// write saves the summary as Markdown to path. runErr is the error the run failed with, if any.
+func (report *runSummary) write(path string, runErr error) error {
+	report.Lock()
+	defer report.Unlock()
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "# VM Extension Sample Run")
+	fmt.Fprintln(&buf)
+	if runErr == nil {
+		fmt.Fprintln(&buf, "**Result:** Succeeded  ")
+	} else {
+		fmt.Fprintf(&buf, "**Result:** Failed: %v  \n", runErr)
+	}
+	fmt.Fprintf(&buf, "**Location:** %s  \n**VM Size:** %s  \n**Operating System:** %s  \n**Correlation ID:** %s\n", location, vmSize, osType, correlationID)
+
+	section := func(title string, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		fmt.Fprintf(&buf, "\n## %s\n\n", title)
+		for _, line := range lines {
+			fmt.Fprintf(&buf, "- %s\n", line)
+		}
+	}
+	section("Resources", report.resources)
+	section("Extensions", report.extensions)
+	section("SSH Host Keys", report.hostKeys)
+
+	if command := connectCommand(report.fqdn, report.address); command != "" {
+		fmt.Fprintln(&buf, "\n## Connecting")
+		fmt.Fprintln(&buf)
+		fmt.Fprintf(&buf, "    %s\n", command)
+	}
+
+	if len(report.steps) > 0 {
+		fmt.Fprintln(&buf, "\n## Steps")
+		fmt.Fprintln(&buf)
+		fmt.Fprintln(&buf, "| Step | Status | Duration |")
+		fmt.Fprintln(&buf, "|------|--------|----------|")
+		for _, step := range report.steps {
+			fmt.Fprintf(&buf, "| %s | %s | %.1fs |\n", step.Step, step.Status, step.Duration)
+		}
+	}
+
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// connectCommand is the command to open a session on the VM, given its public FQDN or IP address, or "" if it has neither. On Linux, it uses
+// the private half of the key installed with -vmaccess-ssh-key-file, if there is one.
+func connectCommand(fqdn, address string) string {
+	host := fqdn
+	if host == "" {
+		host = address
+	}
+	if host == "" {
+		return ""
+	}
+
+	if osType == osWindows {
+		return fmt.Sprintf("mstsc /v:%s", host)
+	}
+
+	user := adminUsername
+	if extensionTypes.contains(extensionVMAccess) {
+		user = accessUsername
+		if accessKeyFile != "" {
+			return fmt.Sprintf("ssh -i %s %s@%s", strings.TrimSuffix(accessKeyFile, ".pub"), user, host)
+		}
+	} else if sshKeyOut != "" {
+		return fmt.Sprintf("ssh -i %s %s@%s", sshKeyOut, user, host)
+	}
+	return fmt.Sprintf("ssh %s@%s", user, host)
+}
+
+// retryableCodes are Azure error codes for failures that are expected to go away on their own, regardless of the HTTP status they came with.
+var retryableCodes = map[string]bool{
+	"AnotherOperationInProgress": true,
+	"OperationNotAllowed":        true,
+	"OperationPreempted":         true,
+	"ResourceNotFound":           true,
+	"RetryableError":             true,
+}
+
+// permanentCodes are Azure error codes for failures that retrying can't fix, even though their HTTP status suggests otherwise.
+var permanentCodes = map[string]bool{
+	"AllocationFailed":                true,
+	"MissingSubscriptionRegistration": true,
+	"QuotaExceeded":                   true,
+	"ReservedResourceName":            true,
+	"ResourceGroupQuotaExceeded":      true,
+	"SkuNotAvailable":                 true,
+	"SubscriptionNotRegistered":       true,
+}
+
+// isRetryable determines whether an operation that failed with err is worth attempting again. The Azure error code is consulted first,
+// falling back to the HTTP status of the response, or, when there was none, to whether the request failed on the network.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if found, ok := serviceError(err); ok {
+		if permanentCodes[found.Code] {
+			return false
+		}
+		if retryableCodes[found.Code] {
+			// OperationNotAllowed is also how Compute reports exhausted quota, which won't free up by waiting.
+			return !(found.Code == "OperationNotAllowed" && strings.Contains(strings.ToLower(found.Message), "quota"))
+		}
+	}
+
+	var status int
+	cause := err
+	switch detailed := err.(type) {
+	case autorest.DetailedError:
+		status, _ = detailed.StatusCode.(int)
+		cause = detailed.Original
+	case *autorest.DetailedError:
+		status, _ = detailed.StatusCode.(int)
+		cause = detailed.Original
+	}
+
+	// A request that failed before Azure answered it, like one whose connection was reset or that timed out, may succeed when sent again.
+	if _, ok := cause.(net.Error); ok && status == 0 {
+		return true
+	}
+
+	switch status {
+	case http.StatusNotFound, http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// serviceError digs through the layers of wrapping applied by the SDK to find the error that was returned by Azure, if any.
+func serviceError(err error) (found azure.ServiceError, ok bool) {
+	for err != nil {
+		switch current := err.(type) {
+		case azure.ServiceError:
+			return current, true
+		case *azure.ServiceError:
+			return *current, true
+		case azure.RequestError:
+			if current.ServiceError != nil {
+				return *current.ServiceError, true
+			}
+			err = current.Original
+		case *azure.RequestError:
+			if current.ServiceError != nil {
+				return *current.ServiceError, true
+			}
+			err = current.Original
+		case autorest.DetailedError:
+			if found, ok = parseServiceError(current.ServiceError); ok {
+				return
+			}
+			err = current.Original
+		case *autorest.DetailedError:
+			if found, ok = parseServiceError(current.ServiceError); ok {
+				return
+			}
+			err = current.Original
+		default:
+			return
+		}
+	}
+	return
+}
+
+// parseServiceError reads the error from the body of a failed response.
+func parseServiceError(body []byte) (found azure.ServiceError, ok bool) {
+	var parsed struct {
+		Error *azure.ServiceError `json:"error"`
+	}
+	if len(body) == 0 || json.Unmarshal(body, &parsed) != nil || parsed.Error == nil || parsed.Error.Code == "" {
+		return
+	}
+	return *parsed.Error, true
+}
+
+// missingRegistration determines whether an error was caused by a resource provider not being registered with the subscription.
+// If so, the namespace of the unregistered provider is returned.
+func missingRegistration(err error) (namespace string, ok bool) {
+	found, ok := serviceError(err)
+	if !ok || found.Code != "MissingSubscriptionRegistration" {
+		return "", false
+	}
+
+	if matches := missingNamespacePattern.FindStringSubmatch(found.Message); matches != nil {
+		return matches[1], true
+	}
+	return "", true
+}
+
+// groupCreationAdvice suggests a way around the failures to create a Resource Group that rerunning as-is won't fix.
+func groupCreationAdvice(err error) string {
+	found, ok := serviceError(err)
+	if !ok {
+		return ""
+	}
+
+	switch found.Code {
+	case "ResourceGroupQuotaExceeded":
+		return ". The subscription has as many Resource Groups as it's allowed. Delete one that is no longer needed, or use -resource-group to create the sample's assets in an existing one."
+	case "ReservedResourceName":
+		return ". The name includes a word that Azure reserves. Change -name-prefix or -name-suffix, or use -resource-group to create the sample's assets in an existing Resource Group."
+	}
+	return ""
+}
+
+// rateLimiter is a token bucket which spaces requests out evenly, while still allowing a small burst after a quiet period.
+type rateLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	burst    int
+	next     time.Time
+}
+
+func newRateLimiter(requestsPerSecond float64) *rateLimiter {
+	return &rateLimiter{
+		interval: time.Duration(float64(time.Second) / requestsPerSecond),
+		burst:    int(requestsPerSecond) + 1,
+	}
+}
+
+// reserve claims the next available token, and returns how long the caller must wait before using it.
+func (l *rateLimiter) reserve() time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if earliest := now.Add(-time.Duration(l.burst) * l.interval); l.next.Before(earliest) {
+		l.next = earliest
+	}
+
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// withCorrelationID marks each request as part of this run, unless it already carries a correlation ID.
+func withCorrelationID(id uuid.UUID) autorest.SendDecorator {
+	const header = "x-ms-correlation-request-id"
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			if r.Header.Get(header) == "" {
+				r.Header.Set(header, id.String())
+			}
+			return s.Do(r)
+		})
+	}
+}
+
+// recordedExchange is what -record-to saves for each HTTP request, as a JSON object in a file of its own. Files are named for the order in
+// which the requests were sent, like 0001-GET.json, and retries are recorded separately. Bodies are saved as text; those holding JSON or
+// form data have the values in redactedFields replaced, and headers in redactedHeaders are replaced outright.
+type recordedExchange struct {
+	Time            time.Time   `json:"time"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	RequestHeaders  http.Header `json:"requestHeaders,omitempty"`
+	RequestBody     string      `json:"requestBody,omitempty"`
+	Status          int         `json:"status,omitempty"`
+	ResponseHeaders http.Header `json:"responseHeaders,omitempty"`
+	ResponseBody    string      `json:"responseBody,omitempty"`
+	Duration        float64     `json:"durationSeconds"`
+	Error           string      `json:"error,omitempty"`
+}
+
+const redacted = "REDACTED"
+
+// redactedHeaders are the HTTP headers that carry credentials.
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// redactedFields are the names, compared ignoring case, of JSON properties and form fields whose values are secrets.
+var redactedFields = map[string]bool{
+	"access_token":      true,
+	"refresh_token":     true,
+	"id_token":          true,
+	"device_code":       true,
+	"client_secret":     true,
+	"password":          true,
+	"adminpassword":     true,
+	"protectedsettings": true,
+}
+
+// withRecording saves each request sent, and the response received, to a file in dir. See recordedExchange.
+func withRecording(dir string) autorest.SendDecorator {
+	var lock sync.Mutex
+	var sequence int
+
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			lock.Lock()
+			sequence++
+			path := filepath.Join(dir, fmt.Sprintf("%04d-%s.json", sequence, r.Method))
+			lock.Unlock()
+
+			exchange := recordedExchange{
+				Time:           time.Now(),
+				Method:         r.Method,
+				URL:            r.URL.String(),
+				RequestHeaders: redactHeaders(r.Header),
+			}
+			if r.Body != nil {
+				body, err := ioutil.ReadAll(r.Body)
+				r.Body.Close()
+				if err != nil {
+					return nil, err
+				}
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				exchange.RequestBody = redactBody(body, r.Header.Get("Content-Type"))
+			}
+
+			resp, err := s.Do(r)
+			exchange.Duration = time.Since(exchange.Time).Seconds()
+			if err != nil {
+				exchange.Error = err.Error()
+			}
+			if resp != nil {
+				exchange.Status = resp.StatusCode
+				exchange.ResponseHeaders = redactHeaders(resp.Header)
+				if resp.Body != nil {
+					body, readErr := ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+					resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+					if readErr != nil && err == nil {
+						err = readErr
+					}
+					exchange.ResponseBody = redactBody(body, resp.Header.Get("Content-Type"))
+					if strings.HasSuffix(strings.ToLower(r.URL.Path), "/listkeys") {
+						exchange.ResponseBody = redactListedKeys(exchange.ResponseBody)
+					}
+				}
+			}
+
+			if contents, marshalErr := json.MarshalIndent(exchange, "", "  "); marshalErr != nil {
+				warnLog.Printf("could not record %s %s. Error: %v", r.Method, r.URL.Path, marshalErr)
+			} else if writeErr := ioutil.WriteFile(path, contents, 0600); writeErr != nil {
+				warnLog.Printf("could not record %s %s. Error: %v", r.Method, r.URL.Path, writeErr)
+			}
+			return resp, err
+		})
+	}
+}
+
+// redactHeaders copies headers, replacing the values of any in redactedHeaders.
+func redactHeaders(headers http.Header) http.Header {
+	copied := http.Header{}
+	for name, values := range headers {
+		copied[name] = values
+	}
+	for _, name := range redactedHeaders {
+		if copied.Get(name) != "" {
+			copied.Set(name, redacted)
+		}
+	}
+	return copied
+}
+
+// redactBody replaces the values of redactedFields in a JSON or form encoded body. Bodies in other formats are returned unchanged.
+func redactBody(body []byte, contentType string) string {
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return string(body)
+		}
+		for name := range form {
+			if redactedFields[strings.ToLower(name)] {
+				form.Set(name, redacted)
+			}
+		}
+		return form.Encode()
+	}
+
+	var parsed interface{}
+	if json.Unmarshal(body, &parsed) == nil {
+		if redactedJSON, err := json.Marshal(redactJSON(parsed)); err == nil {
+			return string(redactedJSON)
+		}
+	}
+	return string(body)
+}
+
+// redactListedKeys replaces the keys in the response to a listKeys operation, like the access keys of a Storage Account, each of which
+// grants full control of it. Elsewhere, a property named keys isn't a secret, like the key permissions of a Key Vault access policy, so
+// this only applies to listKeys responses.
+func redactListedKeys(body string) string {
+	var parsed map[string]interface{}
+	if json.Unmarshal([]byte(body), &parsed) != nil {
+		return body
+	}
+	if _, ok := parsed["keys"]; !ok {
+		return body
+	}
+	parsed["keys"] = redacted
+	if redactedJSON, err := json.Marshal(parsed); err == nil {
+		return string(redactedJSON)
+	}
+	return body
+}
+
+// redactJSON walks a value decoded from JSON, replacing the values of redactedFields wherever they appear.
+func redactJSON(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for name, child := range typed {
+			if redactedFields[strings.ToLower(name)] {
+				typed[name] = redacted
+			} else {
+				typed[name] = redactJSON(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range typed {
+			typed[i] = redactJSON(child)
+		}
+	}
+	return value
+}
+
+// withRateLimit holds each request until the provided rateLimiter allows it to be sent. A request that is cancelled while it's held, through
+// its context or its Cancel channel, is given up on without being sent.
+func withRateLimit(limiter *rateLimiter) autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			if delay := limiter.reserve(); delay > 0 {
+				debugLog.Printf("Waiting %v on the rate limiter before: %s %s", delay, r.Method, r.URL.Path)
+				timer := time.NewTimer(delay)
+				defer timer.Stop()
+				select {
+				case <-timer.C:
+				case <-r.Context().Done():
+					return nil, r.Context().Err()
+				case <-r.Cancel:
+					return nil, fmt.Errorf("%s %s was cancelled while waiting on the rate limiter", r.Method, r.URL.Path)
+				}
+			}
+			return s.Do(r)
+		})
+	}
+}
+
+// preflightTimeout bounds how long checkConnectivity waits on each endpoint.
+const preflightTimeout = 10 * time.Second
+
+// checkConnectivity ensures that each endpoint answers an HTTP request. Any response at all, even an error status, shows the endpoint can
+// be reached; only failing to get one is reported, since the SDK would otherwise surface it as a dial or TLS error deep inside some call.
+func checkConnectivity(endpoints ...string) error {
+	client := newHTTPClient(preflightTimeout)
+
+	var unreachable []string
+	for _, endpoint := range endpoints {
+		debugLog.Print("Checking Connectivity: ", endpoint)
+		resp, err := client.Head(endpoint)
+		if err != nil {
+			unreachable = append(unreachable, fmt.Sprintf("cannot reach Azure endpoint %s (check network/proxy). Error: %v", endpoint, err))
+			continue
+		}
+		resp.Body.Close()
+	}
+	if len(unreachable) > 0 {
+		return errors.New(strings.Join(unreachable, "; "))
+	}
+	return nil
+}
+
+// newHTTPClient creates the client that sends every request made by this sample. Besides the overall timeout for each request, it bounds
+// the time spent on each step of establishing a connection, so that a stalled network fails instead of hanging.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: timeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   10,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
+
+// ensureLocations checks that each of wanted names a region available to the subscription, by either its name or display name.
+func ensureLocations(subscriptionID uuid.UUID, authorizer autorest.Authorizer, wanted ...string) error {
+	client := subscriptions.NewGroupClient()
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	available, err := client.ListLocations(subscriptionID.String())
+	if err != nil {
+		return err
+	}
+
+	squash := func(name string) string {
+		return strings.ToLower(strings.Replace(name, " ", "", -1))
+	}
+
+	known := map[string]bool{}
+	if available.Value != nil {
+		for _, current := range *available.Value {
+			known[squash(to.String(current.Name))] = true
+			known[squash(to.String(current.DisplayName))] = true
+		}
+	}
+
+	for _, name := range wanted {
+		if !known[squash(name)] {
+			return fmt.Errorf("'%s' is not a location available to subscription %s", name, subscriptionID)
+		}
+	}
+	return nil
+}
+
+// restartVirtualMachine restarts a VM that already exists, and waits for it to be running again.
+func restartVirtualMachine(subscriptionID uuid.UUID, group, name string, authorizer autorest.Authorizer) (err error) {
+	client := compute.NewVirtualMachinesClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	if _, err = client.Get(group, name, ""); err != nil {
+		if found, ok := serviceError(err); ok && found.Code == "ResourceNotFound" {
+			return fmt.Errorf("there is no VM named '%s' in resource group '%s'", name, group)
+		}
+		return fmt.Errorf("could not find VM '%s'. Error: %v", name, err)
+	}
+
+	statusLog.Print("Restarting Virtual Machine: ", name)
+	_, errs := client.Restart(group, name, nil)
+	return <-errs
+}
+
+// reapplyVirtualMachine has Azure reapply the state it holds for a VM that already exists, such as its extensions, and waits for that to
+// finish.
+func reapplyVirtualMachine(subscriptionID uuid.UUID, group, name string, authorizer autorest.Authorizer) (err error) {
+	client := compute.NewVirtualMachinesClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	if _, err = client.Get(group, name, ""); err != nil {
+		if found, ok := serviceError(err); ok && found.Code == "ResourceNotFound" {
+			return fmt.Errorf("there is no VM named '%s' in resource group '%s'", name, group)
+		}
+		return fmt.Errorf("could not find VM '%s'. Error: %v", name, err)
+	}
+
+	// The vendored compute client has no reapply operation, but it is shaped just like restart, so the restart request is redirected.
+	req, err := client.RestartPreparer(group, name, nil)
+	if err != nil {
+		return
+	}
+	req.URL.Path = strings.TrimSuffix(req.URL.Path, "/restart") + "/reapply"
+	query := req.URL.Query()
+	query.Set("api-version", reapplyAPIVersion)
+	req.URL.RawQuery = query.Encode()
+
+	statusLog.Print("Reapplying Virtual Machine: ", name)
+	resp, err := client.RestartSender(req)
+	if err == nil {
+		_, err = client.RestartResponder(resp)
+	}
+	if found, ok := serviceError(err); ok && (found.Code == "OperationNotAllowed" || found.Code == "BadRequest") {
+		return fmt.Errorf("VM '%s' can't be reapplied: %s", name, found.Message)
+	}
+	return
+}
+
+// printExtensions writes a table of the extensions installed on an existing VM to stdout. With -with-status, the VM's instance view is
+// expanded so that each extension's latest status message and time are shown alongside its provisioning state.
+func printExtensions(subscriptionID uuid.UUID, group, name string, authorizer autorest.Authorizer) (err error) {
+	client := compute.NewVirtualMachinesClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	var expand compute.InstanceViewTypes
+	if withStatus {
+		expand = compute.InstanceView
+	}
+
+	machine, err := client.Get(group, name, expand)
+	if err != nil {
+		if found, ok := serviceError(err); ok && found.Code == "ResourceNotFound" {
+			return fmt.Errorf("there is no VM named '%s' in resource group '%s'", name, group)
+		}
+		return fmt.Errorf("could not find VM '%s'. Error: %v", name, err)
+	}
+	if machine.Resources == nil || len(*machine.Resources) == 0 {
+		statusLog.Printf("Virtual Machine '%s' has no extensions installed.", name)
+		return
+	}
+
+	// The instance view reports extensions by name, separately from the extension resources themselves.
+	views := map[string]compute.VirtualMachineExtensionInstanceView{}
+	if machine.InstanceView != nil && machine.InstanceView.Extensions != nil {
+		for _, view := range *machine.InstanceView.Extensions {
+			views[strings.ToLower(to.String(view.Name))] = view
+		}
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if withStatus {
+		fmt.Fprintln(table, "NAME\tTYPE\tVERSION\tSTATE\tSTATUS\tTIME")
+	} else {
+		fmt.Fprintln(table, "NAME\tTYPE\tVERSION\tSTATE")
+	}
+	for _, extension := range *machine.Resources {
+		var extensionType, version, state string
+		if props := extension.VirtualMachineExtensionProperties; props != nil {
+			extensionType = to.String(props.Publisher) + "." + to.String(props.Type)
+			version = to.String(props.TypeHandlerVersion)
+			state = to.String(props.ProvisioningState)
+		}
+		if !withStatus {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", to.String(extension.Name), extensionType, version, state)
+			continue
+		}
+
+		message, at := "-", "-"
+		if view, ok := views[strings.ToLower(to.String(extension.Name))]; ok && view.Statuses != nil && len(*view.Statuses) > 0 {
+			latest := (*view.Statuses)[0]
+			message = to.String(latest.DisplayStatus)
+			if detail := strings.Join(strings.Fields(to.String(latest.Message)), " "); detail != "" {
+				message += ": " + detail
+			}
+			if latest.Time != nil {
+				at = latest.Time.UTC().Format(time.RFC3339)
+			}
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", to.String(extension.Name), extensionType, version, state, message, at)
+	}
+	return table.Flush()
+}
+
+// compareExtensions compares each extension chosen with -extension-type or -extension, as this sample would install it, with the one
+// installed on an existing VM, and writes a table of their differences to stdout. Settings are compared key by key. A driftError is
+// returned when any differ.
+func compareExtensions(subscriptionID uuid.UUID, group, name string, authorizer autorest.Authorizer) (err error) {
+	client := compute.NewVirtualMachineExtensionsClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	var drifted []string
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "EXTENSION\tFIELD\tDESIRED\tACTUAL")
+	for _, current := range extensionTypes {
+		var desired compute.VirtualMachineExtension
+		switch current {
+		case extensionVMAccess:
+			desired = vmAccessExtension(nil, "")
+		case extensionMonitorAgent:
+			desired = monitorAgentExtension(nil)
+		}
+		extensionName := to.String(desired.Name)
+
+		actual, getErr := client.Get(group, name, extensionName, "")
+		if getErr != nil {
+			if found, ok := serviceError(getErr); !ok || (found.Code != "ResourceNotFound" && found.Code != "NotFound") {
+				return fmt.Errorf("could not get extension '%s' of VM '%s'. Error: %v", extensionName, name, getErr)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", extensionName, "(extension)", "installed", "(absent)")
+			drifted = append(drifted, extensionName)
+			continue
+		}
+
+		differences := extensionDifferences(desired, actual)
+		for _, difference := range differences {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", extensionName, difference[0], difference[1], difference[2])
+		}
+		if len(differences) > 0 {
+			drifted = append(drifted, extensionName)
+		} else {
+			statusLog.Printf("Extension '%s' Matches Its Desired State", extensionName)
+		}
+	}
+
+	if len(drifted) == 0 {
+		return nil
+	}
+	if err = table.Flush(); err != nil {
+		return
+	}
+	return driftError{names: drifted}
+}
+
+// extensionDifferences lists the fields in which an installed extension differs from the desired one, as the field's name, its desired
+// value, and its actual value. Values are shown as JSON, with "(absent)" standing in for a missing one.
+func extensionDifferences(desired, actual compute.VirtualMachineExtension) (differences [][3]string) {
+	want, got := desired.VirtualMachineExtensionProperties, actual.VirtualMachineExtensionProperties
+	if got == nil {
+		got = &compute.VirtualMachineExtensionProperties{}
+	}
+
+	fields := []struct {
+		name            string
+		desired, actual *string
+	}{
+		{"publisher", want.Publisher, got.Publisher},
+		{"type", want.Type, got.Type},
+		{"typeHandlerVersion", want.TypeHandlerVersion, got.TypeHandlerVersion},
+	}
+	for _, field := range fields {
+		// Azure doesn't preserve the case of publishers and types.
+		if !strings.EqualFold(to.String(field.desired), to.String(field.actual)) {
+			differences = append(differences, [3]string{field.name, driftValue(field.desired), driftValue(field.actual)})
+		}
+	}
+
+	wantSettings, gotSettings := normalizedSettings(want.Settings), normalizedSettings(got.Settings)
+	var keys []string
+	for key := range wantSettings {
+		keys = append(keys, key)
+	}
+	for key := range gotSettings {
+		if _, ok := wantSettings[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		wantValue, wantOK := wantSettings[key]
+		gotValue, gotOK := gotSettings[key]
+		if wantOK && gotOK && reflect.DeepEqual(wantValue, gotValue) {
+			continue
+		}
+		var wantText, gotText interface{}
+		if wantOK {
+			wantText = wantValue
+		}
+		if gotOK {
+			gotText = gotValue
+		}
+		differences = append(differences, [3]string{"settings." + key, driftValue(wantText), driftValue(gotText)})
+	}
+	return
+}
+
+// normalizedSettings round trips an extension's settings through JSON, so that those built by this sample and those read back from Azure
+// hold the same types and can be compared.
+func normalizedSettings(settings *map[string]interface{}) (normalized map[string]interface{}) {
+	if settings == nil {
+		return nil
+	}
+	if encoded, err := json.Marshal(*settings); err == nil {
+		json.Unmarshal(encoded, &normalized)
+	}
+	return
+}
+
+// driftValue formats a value compared by extensionDifferences as JSON, or "(absent)" when there is none.
+func driftValue(value interface{}) string {
+	if text, ok := value.(*string); ok {
+		if text == nil {
+			return "(absent)"
+		}
+		value = *text
+	}
+	if value == nil {
+		return "(absent)"
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+// checkSecretsVault ensures that the Key Vault the VM's certificates are read from allows Azure to do so while deploying a VM, and is in the
+// same region as the VM will be, which Azure also requires.
+func checkSecretsVault(id, location string, authorizer autorest.Authorizer) (err error) {
+	matches := vaultPattern.FindStringSubmatch(id)
+	if matches == nil {
+		return fmt.Errorf("'%s' is not a Key Vault ID", id)
+	}
+	subscriptionID, groupName, name := matches[1], matches[2], matches[3]
+
+	client := keyvault.NewVaultsClient(subscriptionID)
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	vault, err := client.Get(groupName, name)
+	if err != nil {
+		if found, ok := serviceError(err); ok && (found.Code == "ResourceNotFound" || found.Code == "NotFound") {
+			return fmt.Errorf("there is no Key Vault named '%s' in resource group '%s'", name, groupName)
+		}
+		return fmt.Errorf("could not find Key Vault '%s'. Error: %v", name, err)
+	}
+
+	if vault.Properties == nil || !to.Bool(vault.Properties.EnabledForDeployment) {
+		return fmt.Errorf("key vault '%s' doesn't allow VMs to read certificates from it while they're deployed. Enable it with `az keyvault update --name %s --enabled-for-deployment true`", name, name)
+	}
+	if vault.Location != nil && !strings.EqualFold(strings.Replace(*vault.Location, " ", "", -1), location) {
+		return fmt.Errorf("key vault '%s' is in '%s', but must be in '%s' for the VM to read certificates from it", name, *vault.Location, location)
+	}
+	return nil
+}
+
+// getResourceGroup fetches an existing Resource Group for the sample's assets to be created in.
+func getResourceGroup(subscriptionID uuid.UUID, name string, authorizer autorest.Authorizer) (group resources.Group, err error) {
+	client := resources.NewGroupsClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	group, err = client.Get(name)
+	return
+}
+
+func setupResourceGroup(subscriptionID uuid.UUID, authorizer autorest.Authorizer) (created resources.Group, deleter func() <-chan error, err error) {
+	resourceClient := resources.NewGroupsClient(subscriptionID.String())
+	resourceClient.Authorizer = authorizer
+	resourceClient.Sender = sender
+	resourceClient.PollingDelay = pollInterval
+
+	name := resourceName(naming.ResourceGroupName())
+
+	groupAt := location
+	if groupLocation != "" {
+		groupAt = groupLocation
+	}
+
+	err = withRetry(func() (createErr error) {
+		created, createErr = resourceClient.CreateOrUpdate(name, resources.Group{
+			Location: to.StringPtr(groupAt),
+			Tags:     resourceTags("rg"),
+		})
+		return
+	})
+	if err != nil {
+		err = fmt.Errorf("'%s' in %s: %v%s", name, groupAt, err, groupCreationAdvice(err))
+	}
+
+	if err == nil && forceDelete {
+		deleter = func() <-chan error {
+			statusLog.Print("Force Deleting Virtual Machines In: ", *created.Name)
+			return forceDeleteGroup(resourceClient, *created.Name)
+		}
+	} else if err == nil {
+		deleter = func() <-chan error {
+			_, result := resourceClient.Delete(*created.Name, nil)
+			return result
+		}
+	} else {
+		deleter = func() <-chan error {
+			result := make(chan error)
+			close(result)
+			return result
+		}
+	}
+
+	return
+}
+
+// forceDeletionAPIVersion is the Microsoft.Resources API version used to delete a Resource Group with force deletion, which the vendored
+// resources client predates.
+const forceDeletionAPIVersion = "2021-04-01"
+
+// forceDeletableTypes are the types of resource force deletion is applied to. Azure only supports it for VMs and scale sets, and the sample
+// creates no scale sets.
+const forceDeletableTypes = "Microsoft.Compute/virtualMachines"
+
+// forceDeleteGroup deletes a Resource Group as client.Delete would, except that the VMs in it are force deleted.
+func forceDeleteGroup(client resources.GroupsClient, name string) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		defer close(result)
+
+		req, err := client.DeletePreparer(name, nil)
+		if err != nil {
+			result <- err
+			return
+		}
+		query := req.URL.Query()
+		query.Set("api-version", forceDeletionAPIVersion)
+		query.Set("forceDeletionTypes", forceDeletableTypes)
+		req.URL.RawQuery = query.Encode()
+
+		resp, err := client.DeleteSender(req)
+		if err == nil {
+			_, err = client.DeleteResponder(resp)
+		}
+		result <- err
+	}()
+	return result
+}
+
+// setupRegionPairBackup creates an empty Resource Group, named after the primary one, in the region paired with the primary group's region.
+// Resource Group names are unique across a subscription regardless of region, so a "-dr" suffix is appended to the primary group's name.
+// The new group is tagged so that it is easily identified as the disaster recovery target of the primary group.
+func setupRegionPairBackup(subscriptionID uuid.UUID, primary resources.Group, authorizer autorest.Authorizer) (created resources.Group, deleter func() <-chan error, err error) {
+	pairedLocation, ok := pairedRegions[strings.ToLower(*primary.Location)]
+	if !ok {
+		err = fmt.Errorf("no paired region is known for '%s'", *primary.Location)
+		return
+	}
+	debugLog.Printf("Paired Region of %s: %s", *primary.Location, pairedLocation)
+
+	client := resources.NewGroupsClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	tags := map[string]*string{}
+	if given := resourceTags("rg"); given != nil {
+		tags = *given
+	}
+	tags["disasterRecoveryTarget"] = primary.ID
+	tags["primaryLocation"] = primary.Location
+
+	created, err = client.CreateOrUpdate(*primary.Name+"-dr", resources.Group{
+		Location: to.StringPtr(pairedLocation),
+		Tags:     &tags,
+	})
+	if err != nil {
+		deleter = func() <-chan error {
+			result := make(chan error)
+			close(result)
+			return result
+		}
+		return
+	}
+
+	deleter = func() <-chan error {
+		_, result := client.Delete(*created.Name, nil)
+		return result
+	}
+	return
+}
+
+// setupKeyVault creates a secure location to hold the secrets for encrypting and unencrypting the VM created in this sample's OS and Data disks.
+func setupKeyVault(userID, subscriptionID, tenantID uuid.UUID, group resources.Group, authorizer autorest.Authorizer) (<-chan keyvault.Vault, <-chan error) {
+	results, errs := make(chan keyvault.Vault, 1), make(chan error, 1)
+
+	go func() {
+		var err error
+		var created keyvault.Vault
+
+		defer close(results)
+		defer close(errs)
+
+		client := keyvault.NewVaultsClient(subscriptionID.String())
+		client.Authorizer = authorizer
+		client.Sender = sender
+		client.PollingDelay = pollInterval
+
+		vaultName := uuid.NewV4().String()
+		vaultName = strings.Replace(vaultName, "-", "", -1)
+		vaultName = "vault-" + vaultName
+		vaultName = vaultName[:24]
+
+		created, err = client.CreateOrUpdate(*group.Name, vaultName, keyvault.VaultCreateOrUpdateParameters{
+			Location: group.Location,
+			Tags:     resourceTags("vault"),
+			Properties: &keyvault.VaultProperties{
+				AccessPolicies: &[]keyvault.AccessPolicyEntry{
+					{
+						ObjectID: to.StringPtr(userID.String()),
+						TenantID: &tenantID,
+						Permissions: &keyvault.Permissions{
+							Keys:    &[]keyvault.KeyPermissions{keyvault.KeyPermissionsAll},
+							Secrets: &[]keyvault.SecretPermissions{keyvault.SecretPermissionsAll},
+						},
+					},
+					{
+						ObjectID: to.StringPtr(servicePrincipalObjectID), // The ObjectID of the Service Principal (not the application around it) that will be used programmatically by the extension
+						TenantID: &tenantID,
+						Permissions: &keyvault.Permissions{
+							Keys:    &[]keyvault.KeyPermissions{keyvault.KeyPermissionsAll},
+							Secrets: &[]keyvault.SecretPermissions{keyvault.SecretPermissionsAll},
+						},
+					},
+				},
+				EnabledForDiskEncryption: to.BoolPtr(true),
+				Sku: &keyvault.Sku{
+					Family: to.StringPtr("A"),
+					Name:   keyvault.Standard,
+				},
+				TenantID: &tenantID,
+			},
+		})
+
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		results <- created
+	}()
+
+	return results, errs
+}
+
+func setupEncryptionKey(clientID, tenantID uuid.UUID, authorizer autorest.Authorizer, vault keyvault.Vault) (key keys.KeyBundle, err error) {
+	client := keys.New()
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	keyName := "key-" + uuid.NewV4().String()
+
+	key, err = client.CreateKey(vaultURL(vault), keyName, keys.KeyCreateParameters{
+		KeyAttributes: &keys.KeyAttributes{
+			Enabled: to.BoolPtr(true),
+		},
+		KeySize: to.Int32Ptr(2048), // As of writing this sample, 2048 is the only supported KeySize.
+		KeyOps: &[]keys.JSONWebKeyOperation{
+			keys.Encrypt,
+			keys.Decrypt,
+		},
+		Kty: keys.RSA,
+	})
+
+	return
+}
+
+func setupManagedDisk(clientID, subscriptionID, tenantID uuid.UUID, group resources.Group, account storage.Account, vault keyvault.Vault, authorizer, vaultAuthorizer autorest.Authorizer) (<-chan disk.Model, <-chan error) {
+	results, errs := make(chan disk.Model, 1), make(chan error, 1)
+	go func() {
+		var err error
+		var created disk.Model
+		defer close(results)
+		defer close(errs)
+
+		diskClient := disk.NewDisksClient(subscriptionID.String())
+		diskClient.Authorizer = authorizer
+		diskClient.Sender = sender
+		diskClient.PollingDelay = pollInterval
+
+		diskName := dataDiskName
+		if diskName == "" {
+			diskName = "disk-" + uuid.NewV4().String()
+		}
+
+		_, diskErrs := diskClient.CreateOrUpdate(*group.Name, diskName, disk.Model{
+			Location: group.Location,
+			Tags:     resourceTags("disk"),
+			Properties: &disk.Properties{
+				CreationData: &disk.CreationData{
+					CreateOption: disk.Empty,
+				},
+				DiskSizeGB: to.Int32Ptr(64),
+			},
+		}, nil)
+		if err = <-diskErrs; err != nil {
+			errs <- err
+			return
+		}
+
+		created, err = diskClient.Get(*group.Name, diskName)
+		if err != nil {
+			errs <- err
+			return
+		}
+		results <- created
+	}()
+	return results, errs
+}
+
+// setupOSDisk copies a snapshot of an OS disk into a new managed disk that the sample's VM can be created with. The snapshot must be of an OS
+// disk of the operating system chosen with -os, and in the Resource Group's region, since disks can't be copied across regions.
+func setupOSDisk(subscriptionID uuid.UUID, group resources.Group, snapshotID string, authorizer autorest.Authorizer) (created disk.Model, err error) {
+	matches := snapshotPattern.FindStringSubmatch(snapshotID)
+	if matches == nil {
+		err = fmt.Errorf("'%s' is not a snapshot ID", snapshotID)
+		return
+	}
+	snapshotSubscription, snapshotGroup, snapshotName := matches[1], matches[2], matches[3]
+
+	snapshots := disk.NewSnapshotsClient(snapshotSubscription)
+	snapshots.Authorizer = authorizer
+	snapshots.Sender = sender
+	snapshots.PollingDelay = pollInterval
+
+	snapshot, err := snapshots.Get(snapshotGroup, snapshotName)
+	if err != nil {
+		if found, ok := serviceError(err); ok && (found.Code == "ResourceNotFound" || found.Code == "NotFound") {
+			err = fmt.Errorf("there is no snapshot named '%s' in resource group '%s'", snapshotName, snapshotGroup)
+		}
+		return
+	}
+
+	if snapshot.Properties == nil || snapshot.OsType == "" {
+		err = fmt.Errorf("snapshot '%s' is of a data disk, so the VM can't be started from it", snapshotName)
+		return
+	}
+	if !strings.EqualFold(string(snapshot.OsType), osType) {
+		err = fmt.Errorf("snapshot '%s' is of a %s OS disk, but -os is '%s'", snapshotName, snapshot.OsType, osType)
+		return
+	}
+	if snapshot.Location != nil && group.Location != nil && !strings.EqualFold(*snapshot.Location, *group.Location) {
+		err = fmt.Errorf("snapshot '%s' is in '%s', but must be in '%s' to be copied into this sample's OS disk", snapshotName, *snapshot.Location, *group.Location)
+		return
+	}
+
+	client := disk.NewDisksClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	diskName := osDiskName
+	if diskName == "" {
+		diskName = "osdisk-" + uuid.NewV4().String()
+	}
+
+	_, errs := client.CreateOrUpdate(*group.Name, diskName, disk.Model{
+		Location: group.Location,
+		Tags:     resourceTags("disk"),
+		Properties: &disk.Properties{
+			OsType: snapshot.OsType,
+			CreationData: &disk.CreationData{
+				CreateOption:     disk.Copy,
+				SourceResourceID: snapshot.ID,
+			},
+		},
+	}, nil)
+	if err = <-errs; err != nil {
+		return
+	}
+
+	created, err = client.Get(*group.Name, diskName)
+	return
+}
+
+// ensureDisksAbsent checks that none of the named disks already exist in a Resource Group, since disk names must be unique within one.
+// Empty names are skipped.
+func ensureDisksAbsent(subscriptionID uuid.UUID, group string, authorizer autorest.Authorizer, names ...string) error {
+	client := disk.NewDisksClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		_, err := client.Get(group, name)
+		if err == nil {
+			return fmt.Errorf("a disk named '%s' already exists in resource group '%s'", name, group)
+		}
+		if found, ok := serviceError(err); !ok || (found.Code != "ResourceNotFound" && found.Code != "NotFound") {
+			return err
+		}
+	}
+	return nil
+}
+
+// vmCreator is the part of compute.VirtualMachinesClient that setupVirtualMachine uses.
+type vmCreator interface {
+	CreateOrUpdate(resourceGroupName string, VMName string, parameters compute.VirtualMachine, cancel <-chan struct{}) (<-chan compute.VirtualMachine, <-chan error)
+	Get(resourceGroupName string, VMName string, expand compute.InstanceViewTypes) (compute.VirtualMachine, error)
+}
+
+// progressReportingMachines is a vmCreator that follows the creation of a VM itself, through the asynchronous operation Azure reports in
+// its response, instead of leaving that to the client. That way, each intermediate status can be logged as it's reported.
+type progressReportingMachines struct {
+	compute.VirtualMachinesClient
+}
+
+// asyncOperation is the status of an asynchronous operation, as reported by the URL in an Azure-AsyncOperation header.
+type asyncOperation struct {
+	Status          string              `json:"status"`
+	PercentComplete *float64            `json:"percentComplete"`
+	Error           *azure.ServiceError `json:"error"`
+}
+
+func (machines progressReportingMachines) CreateOrUpdate(resourceGroupName string, VMName string, parameters compute.VirtualMachine, cancel <-chan struct{}) (<-chan compute.VirtualMachine, <-chan error) {
+	results, errs := make(chan compute.VirtualMachine, 1), make(chan error, 1)
+	go func() {
+		var created compute.VirtualMachine
+		var err error
+		defer func() {
+			results <- created
+			errs <- err
+			close(results)
+			close(errs)
+		}()
+
+		req, err := machines.CreateOrUpdatePreparer(resourceGroupName, VMName, parameters, cancel)
+		if err != nil {
+			return
+		}
+		resp, err := machines.Do(req)
+		if err != nil {
+			return
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+			// The client's responder turns the failure into an error just as CreateOrUpdate would.
+			_, err = machines.CreateOrUpdateResponder(resp)
+			return
+		}
+		resp.Body.Close()
+
+		if err = machines.follow(resp, cancel); err != nil {
+			return
+		}
+		created, err = machines.Get(resourceGroupName, VMName, "")
+	}()
+	return results, errs
+}
+
+// follow polls the operation that resp started until it finishes. Azure reports on it through the URL in the Azure-AsyncOperation header
+// when there is one, and otherwise through the URL in the Location header, which answers 202 until the operation is done.
+func (machines progressReportingMachines) follow(resp *http.Response, cancel <-chan struct{}) error {
+	operationURL, byLocation := resp.Header.Get("Azure-AsyncOperation"), false
+	if operationURL == "" {
+		operationURL, byLocation = resp.Header.Get("Location"), true
+	}
+	if operationURL == "" {
+		debugLog.Print("Operation Finished Synchronously")
+		return nil
+	}
+
+	lastReported := ""
+	for {
+		delay := pollInterval
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			delay = time.Duration(seconds) * time.Second
+		}
+		select {
+		case <-cancel:
+			return errors.New("stopped waiting for the VM to be created")
+		case <-time.After(delay):
+		}
+
+		req, err := autorest.Prepare(&http.Request{Cancel: cancel}, autorest.AsGet(), autorest.WithBaseURL(operationURL))
+		if err != nil {
+			return err
+		}
+		if resp, err = machines.Do(req); err != nil {
+			return err
+		}
+
+		if byLocation {
+			resp.Body.Close()
+			switch resp.StatusCode {
+			case http.StatusAccepted:
+				statusLog.Print("VM Creation: InProgress")
+				continue
+			case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+				return nil
+			default:
+				return fmt.Errorf("polling '%s' failed with status %s", operationURL, resp.Status)
+			}
+		}
+
+		var operation asyncOperation
+		err = autorest.Respond(resp, azure.WithErrorUnlessStatusCode(http.StatusOK), autorest.ByUnmarshallingJSON(&operation), autorest.ByClosing())
+		if err != nil {
+			return err
+		}
+
+		report := operation.Status
+		if operation.PercentComplete != nil {
+			report = fmt.Sprintf("%s (%.0f%%)", operation.Status, *operation.PercentComplete)
+		}
+		if report != lastReported {
+			statusLog.Print("VM Creation: ", report)
+			lastReported = report
+		} else {
+			debugLog.Print("VM Creation: ", report)
+		}
+
+		switch {
+		case strings.EqualFold(operation.Status, "Succeeded"):
+			return nil
+		case strings.EqualFold(operation.Status, "Failed"), strings.EqualFold(operation.Status, "Canceled"):
+			if operation.Error != nil {
+				return *operation.Error
+			}
+			return fmt.Errorf("creating the VM finished in status '%s'", operation.Status)
+		}
+	}
+}
+
+// nicCreator is the part of network.InterfacesClient that setupNetworkInterface uses.
+type nicCreator interface {
+	CreateOrUpdate(resourceGroupName string, networkInterfaceName string, parameters network.Interface, cancel <-chan struct{}) (<-chan network.Interface, <-chan error)
+	Get(resourceGroupName string, networkInterfaceName string, expand string) (network.Interface, error)
+}
+
+// setupVirtualMachine creates the sample's VM, named vmName, along with its network interfaces, through the provided clients. The authorizer is used for
+// anything else that must be created along the way, like a Public IP Address. When osDisk is provided, the VM is started from it rather
+// than from a marketplace image.
+func setupVirtualMachine(machines vmCreator, interfaces nicCreator, clientID, subscriptionID, tenantID uuid.UUID, resourceGroup resources.Group, vmName string, storageAccount storage.Account, vault keyvault.Vault, vaultAuthorizer autorest.Authorizer, dataDisk disk.Model, osDisk *disk.Model, plan *compute.Plan, subnet network.Subnet, securityGroup *network.SecurityGroup, authorizer autorest.Authorizer, cancel <-chan struct{}) (created compute.VirtualMachine, err error) {
+
+	storageProfile := &compute.StorageProfile{
+		OsDisk: &compute.OSDisk{
+			Caching: compute.CachingTypes(osDiskCaching),
+		},
+		DataDisks: &[]compute.DataDisk{
+			{
+				CreateOption: compute.Attach,
+				Lun:          to.Int32Ptr(0),
+				ManagedDisk: &compute.ManagedDiskParameters{
+					ID:                 dataDisk.ID,
+					StorageAccountType: compute.StorageAccountTypes(storageAccount.Sku.Name),
+				},
+			},
+		},
+	}
+	var profile *compute.OSProfile
+	if osDisk != nil {
+		storageProfile.OsDisk.CreateOption = compute.Attach
+		storageProfile.OsDisk.OsType = compute.OperatingSystemTypes(osDisk.OsType)
+		storageProfile.OsDisk.ManagedDisk = &compute.ManagedDiskParameters{ID: osDisk.ID}
+	} else {
+		storageProfile.ImageReference = imageReference()
+		storageProfile.OsDisk.CreateOption = compute.FromImage
+		if osDiskName != "" {
+			storageProfile.OsDisk.Name = to.StringPtr(osDiskName)
+		}
+		storageProfile.OsDisk.DiskSizeGB = to.Int32Ptr(64)
+
+		hostName := computerName
+		if hostName == "" {
+			hostName = deriveComputerName(vmName)
+		}
+		debugLog.Print("Computer Name: ", hostName)
+		profile = osProfile(hostName)
+	}
+	statusLog.Print("OS Disk Caching: ", osDiskCaching)
+	if licenseType != "" {
+		statusLog.Print("License Type: ", licenseType)
+	}
+
+	if ipForwarding {
+		statusLog.Print("IP Forwarding: enabled on every network interface")
+	}
+
+	networkCards := make([]compute.NetworkInterfaceReference, 0, nicCount)
+	for i := 0; i < nicCount; i++ {
+		var networkCard network.Interface
+		networkCard, err = setupNetworkInterface(interfaces, subscriptionID, resourceGroup, subnet, network.SubResource{ID: to.StringPtr(vmName)}, i, securityGroup, authorizer)
+		if err != nil {
+			return
+		}
+		summary.addResource("Network Interface", *networkCard.Name)
+		if nicCount > 1 {
+			statusLog.Print("Created Network Interface: ", *networkCard.Name)
+		}
+
+		networkCards = append(networkCards, compute.NetworkInterfaceReference{
+			ID: networkCard.ID,
+			NetworkInterfaceReferenceProperties: &compute.NetworkInterfaceReferenceProperties{
+				Primary: to.BoolPtr(i == 0),
+			},
+		})
+	}
+
+	var storageURI *string
+	if storageAccount.PrimaryEndpoints != nil {
+		storageURI = (*storageAccount.PrimaryEndpoints).Blob
+	} else {
+		err = errors.New("No storage endpoint found")
+		return
+	}
+	debugLog.Print("Storage URL: ", *storageAccount.ID)
+
+	_, createErrs := machines.CreateOrUpdate(*resourceGroup.Name, vmName, compute.VirtualMachine{
+		Location: resourceGroup.Location,
+		Tags:     resourceTags("vm"),
+		Identity: vmIdentity(),
+		Plan:     plan,
 		VirtualMachineProperties: &compute.VirtualMachineProperties{
+			LicenseType: selectedLicenseType(),
 			DiagnosticsProfile: &compute.DiagnosticsProfile{
 				BootDiagnostics: &compute.BootDiagnostics{
 					Enabled:    to.BoolPtr(true),
 					StorageURI: storageURI,
 				},
 			},
-			HardwareProfile: &compute.HardwareProfile{
-				VMSize: vmProfile,
+			HardwareProfile: &compute.HardwareProfile{
+				VMSize: compute.VirtualMachineSizeTypes(vmSize),
+			},
+			NetworkProfile: &compute.NetworkProfile{
+				NetworkInterfaces: &networkCards,
+			},
+			OsProfile:      profile,
+			StorageProfile: storageProfile,
+		},
+	}, cancel)
+	if err = <-createErrs; err != nil {
+		return
+	}
+
+	err = withRetry(func() (getErr error) {
+		created, getErr = machines.Get(*resourceGroup.Name, vmName, "")
+		return
+	})
+	return
+}
+
+// runningPowerState is the status code a VM's instance view reports once it has started.
+const runningPowerState = "PowerState/running"
+
+// serialLogLines is how many of the last lines of a VM's serial console log are included when it fails to boot.
+const serialLogLines = 20
+
+// waitForBoot polls a VM's instance view until it reports that the VM is running. If it doesn't within -boot-timeout, the error returned
+// includes the last power state reported, and the end of the VM's serial console log if boot diagnostics captured one.
+func waitForBoot(machines vmCreator, subscriptionID uuid.UUID, group resources.Group, name string, account storage.Account, authorizer autorest.Authorizer) error {
+	deadline := time.Now().Add(bootTimeout)
+	state := "unknown"
+	var view *compute.VirtualMachineInstanceView
+	for {
+		vm, err := machines.Get(*group.Name, name, compute.InstanceView)
+		if err != nil {
+			return err
+		}
+		if vm.VirtualMachineProperties != nil && vm.InstanceView != nil {
+			view = vm.InstanceView
+			if view.Statuses != nil {
+				for _, status := range *view.Statuses {
+					if code := to.String(status.Code); strings.HasPrefix(code, "PowerState/") {
+						state = code
+					}
+				}
+			}
+		}
+		if state == runningPowerState {
+			return nil
+		}
+		if time.Now().Add(pollInterval).After(deadline) {
+			break
+		}
+		debugLog.Print("Power State: ", state)
+		time.Sleep(pollInterval)
+	}
+
+	message := fmt.Sprintf("VM '%s' was provisioned but never reached %s within %v. Last power state: %s", name, runningPowerState, bootTimeout, state)
+	if view != nil && view.BootDiagnostics != nil && view.BootDiagnostics.SerialConsoleLogBlobURI != nil {
+		if tail, err := readSerialLog(subscriptionID, group, account, *view.BootDiagnostics.SerialConsoleLogBlobURI, serialLogLines, authorizer); err != nil {
+			debugLog.Print("could not read the serial console log: ", err)
+		} else if tail != "" {
+			message += "\nSerial console log:\n" + tail
+		}
+	}
+	return errors.New(message)
+}
+
+// readSerialLog downloads the serial console log that boot diagnostics saved to the sample's Storage Account, and returns up to maxLines of
+// its last lines, or all of them if maxLines is 0.
+func readSerialLog(subscriptionID uuid.UUID, group resources.Group, account storage.Account, blobURI string, maxLines int, authorizer autorest.Authorizer) (tail string, err error) {
+	parsed, err := url.Parse(blobURI)
+	if err != nil {
+		return
+	}
+	path := strings.SplitN(strings.TrimPrefix(parsed.Path, "/"), "/", 2)
+	if len(path) != 2 {
+		return "", fmt.Errorf("'%s' is not the URL of a blob", blobURI)
+	}
+
+	accounts := storage.NewAccountsClient(subscriptionID.String())
+	accounts.Authorizer = authorizer
+	accounts.Sender = sender
+	accounts.PollingDelay = pollInterval
+
+	accountKeys, err := accounts.ListKeys(*group.Name, *account.Name)
+	if err != nil {
+		return
+	}
+	if accountKeys.Keys == nil || len(*accountKeys.Keys) == 0 {
+		return "", fmt.Errorf("storage account '%s' has no keys", *account.Name)
+	}
+
+	client, err := blobs.NewBasicClientOnSovereignCloud(*account.Name, to.String((*accountKeys.Keys)[0].Value), environment)
+	if err != nil {
+		return
+	}
+	client.HTTPClient = newHTTPClient(requestTimeout)
+	service := client.GetBlobService()
+
+	contents, err := service.GetContainerReference(path[0]).GetBlobReference(path[1]).Get(nil)
+	if err != nil {
+		return
+	}
+	defer contents.Close()
+	serialLog, err := ioutil.ReadAll(contents)
+	if err != nil {
+		return
+	}
+
+	lines := strings.Split(strings.TrimRight(string(serialLog), "\r\n"), "\n")
+	if maxLines > 0 && len(lines) > maxLines {
+		lines = lines[len(lines)-maxLines:]
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// diagnostics is the state of a VM that failed, collected by -dump-on-failure.
+type diagnostics struct {
+	CollectedAt       time.Time                           `json:"collectedAt"`
+	CorrelationID     string                              `json:"correlationId"`
+	Error             string                              `json:"error"`
+	VirtualMachine    *compute.VirtualMachineInstanceView `json:"virtualMachine,omitempty"`
+	Extensions        []compute.VirtualMachineExtension   `json:"extensions,omitempty"`
+	NetworkInterfaces []network.Interface                 `json:"networkInterfaces,omitempty"`
+	SerialConsoleLog  string                              `json:"serialConsoleLog,omitempty"`
+	Problems          []string                            `json:"problems,omitempty"`
+}
+
+// dumpDiagnostics collects the state of the VM named vmName after runErr, and writes it to a timestamped file in -output-dir, or the
+// working directory. Anything that can't be collected is noted in the file rather than stopping the rest. When there's no VM to collect
+// the state of, nothing is written, and path is empty.
+func dumpDiagnostics(subscriptionID uuid.UUID, group resources.Group, vmName string, account storage.Account, runErr error, authorizer autorest.Authorizer) (path string, err error) {
+	machines := compute.NewVirtualMachinesClient(subscriptionID.String())
+	machines.Authorizer = authorizer
+	machines.Sender = sender
+	machines.PollingDelay = pollInterval
+
+	vm, err := machines.Get(*group.Name, vmName, compute.InstanceView)
+	if err != nil {
+		if found, ok := serviceError(err); ok && (found.Code == "ResourceNotFound" || found.Code == "NotFound") {
+			debugLog.Printf("Not Collecting Diagnostics, VM '%s' Was Never Created", vmName)
+			return "", nil
+		}
+		return
+	}
+
+	bundle := diagnostics{
+		CollectedAt:   time.Now().UTC(),
+		CorrelationID: correlationID.String(),
+		Error:         runErr.Error(),
+	}
+	if vm.VirtualMachineProperties == nil {
+		bundle.Problems = append(bundle.Problems, "the VM has no properties")
+	} else {
+		bundle.VirtualMachine = vm.InstanceView
+
+		extensions := compute.NewVirtualMachineExtensionsClient(subscriptionID.String())
+		extensions.Authorizer = authorizer
+		extensions.Sender = sender
+		extensions.PollingDelay = pollInterval
+		if vm.Resources != nil {
+			for _, installed := range *vm.Resources {
+				extension, getErr := extensions.Get(*group.Name, vmName, to.String(installed.Name), "instanceView")
+				if getErr != nil {
+					bundle.Problems = append(bundle.Problems, fmt.Sprintf("could not fetch extension '%s'. Error: %v", to.String(installed.Name), getErr))
+					continue
+				}
+				bundle.Extensions = append(bundle.Extensions, extension)
+			}
+		}
+
+		interfaces := network.NewInterfacesClient(subscriptionID.String())
+		interfaces.Authorizer = authorizer
+		interfaces.Sender = sender
+		interfaces.PollingDelay = pollInterval
+		if vm.NetworkProfile != nil && vm.NetworkProfile.NetworkInterfaces != nil {
+			for _, reference := range *vm.NetworkProfile.NetworkInterfaces {
+				name := to.String(reference.ID)
+				name = name[strings.LastIndex(name, "/")+1:]
+				networkCard, getErr := interfaces.Get(*group.Name, name, "")
+				if getErr != nil {
+					bundle.Problems = append(bundle.Problems, fmt.Sprintf("could not fetch network interface '%s'. Error: %v", name, getErr))
+					continue
+				}
+				bundle.NetworkInterfaces = append(bundle.NetworkInterfaces, networkCard)
+			}
+		}
+
+		if view := vm.InstanceView; view != nil && view.BootDiagnostics != nil && view.BootDiagnostics.SerialConsoleLogBlobURI != nil && account.Name != nil {
+			serialLog, readErr := readSerialLog(subscriptionID, group, account, *view.BootDiagnostics.SerialConsoleLogBlobURI, 0, authorizer)
+			if readErr != nil {
+				bundle.Problems = append(bundle.Problems, fmt.Sprintf("could not read the serial console log. Error: %v", readErr))
+			}
+			bundle.SerialConsoleLog = serialLog
+		}
+	}
+
+	encoded, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return
+	}
+	dir := outputDir
+	if dir == "" {
+		dir = "."
+	}
+	path = filepath.Join(dir, fmt.Sprintf("diagnostics-%s.json", bundle.CollectedAt.Format("20060102T150405Z")))
+	err = ioutil.WriteFile(path, append(encoded, '\n'), 0644)
+	return
+}
+
+// setupCustomScriptExtension installs the Linux CustomScript extension on a VM, handing it a script to run inline.
+func setupCustomScriptExtension(subscriptionID uuid.UUID, group resources.Group, vm compute.VirtualMachine, script []byte, authorizer autorest.Authorizer) (created compute.VirtualMachineExtension, err error) {
+	debugLog.Printf("Script Size: %d bytes", len(script))
+	return installExtension(subscriptionID, group, vm, customScriptExtension(vm.Location, script), authorizer)
+}
+
+// installExtension adds an extension to a VM and waits for it to finish provisioning. If that takes longer than -extension-timeout,
+// the operation is abandoned and an extensionTimeoutError describing the extension's last reported status is returned.
+func installExtension(subscriptionID uuid.UUID, group resources.Group, vm compute.VirtualMachine, extension compute.VirtualMachineExtension, authorizer autorest.Authorizer) (created compute.VirtualMachineExtension, err error) {
+	client := compute.NewVirtualMachineExtensionsClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	debugLog.Printf("Installing Extension: %s (%s/%s %s)", *extension.Name, to.String(extension.Publisher), to.String(extension.VirtualMachineExtensionProperties.Type), to.String(extension.TypeHandlerVersion))
+	debugLog.Print("Auto Upgrade Minor Version: ", to.Bool(extension.AutoUpgradeMinorVersion))
+
+	if outputDir != "" {
+		defer saveExtensionStatus(client, *group.Name, *vm.Name, *extension.Name)
+	}
+
+	cancel := make(chan struct{})
+	if extensionTimeout > 0 {
+		timer := time.AfterFunc(extensionTimeout, func() {
+			close(cancel)
+		})
+		defer timer.Stop()
+	}
+
+	results, errs := client.CreateOrUpdate(*group.Name, *vm.Name, *extension.Name, extension, cancel)
+	created, err = <-results, <-errs
+	if err == nil {
+		if created.VirtualMachineExtensionProperties != nil && created.ProvisioningState != nil && !strings.EqualFold(*created.ProvisioningState, "Succeeded") {
+			err = fmt.Errorf("extension '%s' finished provisioning in state '%s'", *extension.Name, *created.ProvisioningState)
+		}
+		return
+	}
+
+	select {
+	case <-cancel:
+		timeoutErr := extensionTimeoutError{name: *extension.Name, timeout: extensionTimeout}
+		if current, getErr := client.Get(*group.Name, *vm.Name, *extension.Name, "instanceView"); getErr == nil {
+			timeoutErr.status = describeExtensionStatus(current)
+		} else {
+			debugLog.Print("could not fetch extension instance view: ", getErr)
+		}
+		err = timeoutErr
+	default:
+	}
+	return
+}
+
+// hostKeyScript prints the fingerprint of each of a Linux VM's SSH host keys, one per line.
+const hostKeyScript = `#!/bin/sh
+for key in /etc/ssh/ssh_host_*_key.pub; do
+	ssh-keygen -lf "$key"
+done
+`
+
+// getHostKeys runs hostKeyScript on a VM through the CustomScript extension, and collects the fingerprints it printed from the extension's
+// instance view.
+func getHostKeys(subscriptionID uuid.UUID, group resources.Group, vm compute.VirtualMachine, authorizer autorest.Authorizer) (fingerprints []string, err error) {
+	var extension compute.VirtualMachineExtension
+	extension, err = installExtension(subscriptionID, group, vm, customScriptExtension(vm.Location, []byte(hostKeyScript)), authorizer)
+	if err != nil {
+		return
+	}
+
+	client := compute.NewVirtualMachineExtensionsClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	extension, err = client.Get(*group.Name, *vm.Name, *extension.Name, "instanceView")
+	if err != nil {
+		return
+	}
+
+	if extension.VirtualMachineExtensionProperties != nil && extension.InstanceView != nil && extension.InstanceView.Substatuses != nil {
+		for _, status := range *extension.InstanceView.Substatuses {
+			if !strings.Contains(to.String(status.Code), "StdOut") {
+				continue
+			}
+			for _, line := range strings.Split(to.String(status.Message), "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					fingerprints = append(fingerprints, line)
+				}
+			}
+		}
+	}
+
+	if len(fingerprints) == 0 {
+		err = fmt.Errorf("the VM reported no SSH host keys. Extension status: %s", describeExtensionStatus(extension))
+	}
+	return
+}
+
+// saveExtensionStatus writes the instance view of an extension, including the statuses and messages it has reported, to -output-dir.
+// Failing to do so doesn't affect the run, so it is only reported as a warning.
+func saveExtensionStatus(client compute.VirtualMachineExtensionsClient, group, vm, name string) {
+	extension, err := client.Get(group, vm, name, "instanceView")
+	if err != nil {
+		warnLog.Printf("could not fetch the instance view of extension '%s'. Error: %v", name, err)
+		return
+	}
+
+	var view interface{}
+	if extension.VirtualMachineExtensionProperties != nil {
+		view = extension.InstanceView
+	}
+	encoded, err := json.MarshalIndent(view, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(outputDir, fmt.Sprintf("extension-%s.json", name)), append(encoded, '\n'), 0644)
+	}
+	if err != nil {
+		warnLog.Printf("could not save the instance view of extension '%s'. Error: %v", name, err)
+	}
+}
+
+// extensionTimeoutError is returned when an extension doesn't finish provisioning within -extension-timeout.
+type extensionTimeoutError struct {
+	name    string
+	timeout time.Duration
+	status  string
+}
+
+func (e extensionTimeoutError) Error() string {
+	message := fmt.Sprintf("extension '%s' did not finish provisioning within %v", e.name, e.timeout)
+	if e.status != "" {
+		message += ". Last reported status: " + e.status
+	}
+	return message
+}
+
+// driftError is returned by compareExtensions when an installed extension differs from the one this sample would install.
+type driftError struct {
+	names []string
+}
+
+func (e driftError) Error() string {
+	return fmt.Sprintf("extensions differ from their desired state: %s", strings.Join(e.names, ", "))
+}
+
+// describeExtensionStatus summarizes the statuses reported in an extension's instance view.
+func describeExtensionStatus(extension compute.VirtualMachineExtension) string {
+	if extension.VirtualMachineExtensionProperties == nil || extension.InstanceView == nil {
+		return to.String(extension.ProvisioningState)
+	}
+
+	var described []string
+	for _, statuses := range []*[]compute.InstanceViewStatus{extension.InstanceView.Statuses, extension.InstanceView.Substatuses} {
+		if statuses == nil {
+			continue
+		}
+		for _, status := range *statuses {
+			entry := to.String(status.DisplayStatus)
+			if status.Message != nil {
+				entry += ": " + strings.TrimSpace(*status.Message)
+			}
+			described = append(described, entry)
+		}
+	}
+
+	if len(described) == 0 {
+		return to.String(extension.ProvisioningState)
+	}
+	return strings.Join(described, "; ")
+}
+
+// validateComputerName ensures that a name may be used as the host name of a VM running the selected operating system.
+func validateComputerName(name string) error {
+	if maxLength := maxComputerNameLength[osType]; len(name) > maxLength {
+		return fmt.Errorf("computer name '%s' is %d characters long, but may be at most %d on %s", name, len(name), maxLength, osType)
+	}
+	if !computerNamePattern.MatchString(name) {
+		return fmt.Errorf("computer name '%s' may only contain letters, digits, and hyphens, and may not start or end with a hyphen", name)
+	}
+	if strings.Trim(name, "0123456789") == "" {
+		return fmt.Errorf("computer name '%s' may not consist solely of digits", name)
+	}
+	return nil
+}
+
+// deriveComputerName creates a valid host name from a VM's resource name, which may use characters or lengths that host names can't.
+func deriveComputerName(vmName string) string {
+	derived := []rune(strings.ToLower(vmName))
+	for i, r := range derived {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			derived[i] = '-'
+		}
+	}
+
+	maxLength := maxComputerNameLength[osType]
+
+	name := string(derived)
+	if len(name) > maxLength {
+		name = name[:maxLength]
+	}
+	name = strings.Trim(name, "-")
+
+	if validateComputerName(name) != nil {
+		name = "vm" + name
+		if len(name) > maxLength {
+			name = strings.TrimRight(name[:maxLength], "-")
+		}
+	}
+	return name
+}
+
+// windowsTimeZone finds the time zone ID in windowsTimeZones that name refers to, ignoring case.
+func windowsTimeZone(name string) (id string, ok bool) {
+	for _, candidate := range windowsTimeZones {
+		if strings.EqualFold(candidate, strings.TrimSpace(name)) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// readUnattendContent reads the unattend.xml snippet named by -unattend-content, ensuring that it is well formed and targets a pass,
+// component, and setting that Azure allows.
+func readUnattendContent() (string, error) {
+	if osType != osWindows {
+		return "", errors.New("-unattend-content may only be used with -os windows")
+	}
+
+	if unattendPass != string(compute.OobeSystem) {
+		return "", fmt.Errorf("'%s' is not a supported unattend pass. This sample expects '%s'", unattendPass, compute.OobeSystem)
+	}
+	if unattendComp != string(compute.MicrosoftWindowsShellSetup) {
+		return "", fmt.Errorf("'%s' is not a supported unattend component. This sample expects '%s'", unattendComp, compute.MicrosoftWindowsShellSetup)
+	}
+	if unattendSetting != string(compute.AutoLogon) && unattendSetting != string(compute.FirstLogonCommands) {
+		return "", fmt.Errorf("'%s' is not a supported unattend setting. This sample expects '%s' or '%s'", unattendSetting, compute.AutoLogon, compute.FirstLogonCommands)
+	}
+
+	contents, err := ioutil.ReadFile(unattendFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read unattend content '%s'. Error: %v", unattendFile, err)
+	}
+	if len(contents) > maxUnattendContentLength {
+		return "", fmt.Errorf("unattend content '%s' is %d bytes, but may be at most %d", unattendFile, len(contents), maxUnattendContentLength)
+	}
+
+	var root string
+	decoder := xml.NewDecoder(strings.NewReader(string(contents)))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("unattend content '%s' is not valid XML. Error: %v", unattendFile, err)
+		}
+		if start, ok := token.(xml.StartElement); ok && root == "" {
+			root = start.Name.Local
+		}
+	}
+
+	if root != unattendSetting {
+		return "", fmt.Errorf("unattend content '%s' must have <%s> as its root element, but found <%s>", unattendFile, unattendSetting, root)
+	}
+	return string(contents), nil
+}
+
+// osProfile describes how the operating system of the sample's VM should be provisioned.
+func osProfile(hostName string) *compute.OSProfile {
+	profile := &compute.OSProfile{
+		ComputerName:  to.StringPtr(hostName),
+		AdminUsername: to.StringPtr(adminUsername),
+		AdminPassword: to.StringPtr("azureRocksWithGo!"),
+	}
+
+	if osType == osWindows {
+		profile.WindowsConfiguration = &compute.WindowsConfiguration{
+			ProvisionVMAgent:       to.BoolPtr(true),
+			EnableAutomaticUpdates: to.BoolPtr(true),
+		}
+		if timeZone != "" {
+			debugLog.Print("Time Zone: ", timeZone)
+			profile.WindowsConfiguration.TimeZone = to.StringPtr(timeZone)
+		}
+		if unattendContent != "" {
+			debugLog.Printf("Unattend Content: %s/%s/%s", unattendPass, unattendComp, unattendSetting)
+			profile.WindowsConfiguration.AdditionalUnattendContent = &[]compute.AdditionalUnattendContent{
+				{
+					PassName:      compute.PassNames(unattendPass),
+					ComponentName: compute.ComponentNames(unattendComp),
+					SettingName:   compute.SettingNames(unattendSetting),
+					Content:       to.StringPtr(unattendContent),
+				},
+			}
+		}
+	} else {
+		profile.LinuxConfiguration = &compute.LinuxConfiguration{
+			DisablePasswordAuthentication: to.BoolPtr(false),
+		}
+		if sshPublicKey != "" {
+			profile.LinuxConfiguration.SSH = &compute.SSHConfiguration{
+				PublicKeys: &[]compute.SSHPublicKey{
+					{
+						Path:    to.StringPtr(fmt.Sprintf("/home/%s/.ssh/authorized_keys", adminUsername)),
+						KeyData: to.StringPtr(sshPublicKey),
+					},
+				},
+			}
+		}
+	}
+
+	if secretsVault != "" {
+		certificates := make([]compute.VaultCertificate, 0, len(certificateURLs))
+		for _, certificate := range certificateURLs {
+			debugLog.Print("Certificate: ", certificate)
+			installed := compute.VaultCertificate{CertificateURL: to.StringPtr(certificate)}
+			if osType == osWindows {
+				installed.CertificateStore = to.StringPtr(certificateStore)
+			}
+			certificates = append(certificates, installed)
+		}
+		profile.Secrets = &[]compute.VaultSecretGroup{
+			{
+				SourceVault:       &compute.SubResource{ID: to.StringPtr(secretsVault)},
+				VaultCertificates: &certificates,
+			},
+		}
+	}
+
+	if cloudInitContent != nil {
+		debugLog.Printf("Cloud-Init Size: %d bytes", len(cloudInitContent))
+		profile.CustomData = to.StringPtr(base64.StdEncoding.EncodeToString(cloudInitContent))
+	}
+	return profile
+}
+
+// sshKeyBits is the size of the RSA key generated for -ssh-private-key-out. The vendored compute API only accepts RSA keys for a VM's
+// administrator, so there's no choice of key type.
+const sshKeyBits = 3072
+
+// writeSSHKey generates an RSA key pair, writes its private key to path in PEM form, readable only by its owner, and returns its public key
+// in the OpenSSH authorized_keys form Azure expects. An existing file is only replaced when overwrite is set.
+func writeSSHKey(path string, overwrite bool) (publicKey string, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, sshKeyBits)
+	if err != nil {
+		return "", fmt.Errorf("could not generate SSH key. Error: %v", err)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flags, 0600)
+	if os.IsExist(err) {
+		return "", fmt.Errorf("'%s' already exists. Use -force to overwrite it with the generated private key", path)
+	} else if err != nil {
+		return "", fmt.Errorf("could not write SSH private key '%s'. Error: %v", path, err)
+	}
+	defer file.Close()
+
+	// A file being overwritten keeps its permissions, which ssh refuses to use a private key with unless only the owner can read it.
+	if err = file.Chmod(0600); err != nil {
+		return
+	}
+	if err = pem.Encode(file, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}); err != nil {
+		return "", fmt.Errorf("could not write SSH private key '%s'. Error: %v", path, err)
+	}
+
+	// The wire format of an RSA public key is its type, exponent, and modulus, each prefixed with its length.
+	var wire bytes.Buffer
+	writeField := func(field []byte) {
+		binary.Write(&wire, binary.BigEndian, uint32(len(field)))
+		wire.Write(field)
+	}
+	writeField([]byte("ssh-rsa"))
+	for _, number := range []*big.Int{big.NewInt(int64(key.E)), key.N} {
+		// The exponent and modulus are read as signed, so a leading zero keeps a set top bit from making them negative.
+		field := number.Bytes()
+		if field[0]&0x80 != 0 {
+			field = append([]byte{0}, field...)
+		}
+		writeField(field)
+	}
+	return "ssh-rsa " + base64.StdEncoding.EncodeToString(wire.Bytes()), nil
+}
+
+// imageReference identifies the marketplace image the sample's VM is created from.
+func imageReference() *compute.ImageReference {
+	if osType == osWindows {
+		return &compute.ImageReference{
+			Publisher: to.StringPtr("MicrosoftWindowsServer"),
+			Offer:     to.StringPtr("WindowsServer"),
+			Sku:       to.StringPtr("2016-Datacenter"),
+			Version:   to.StringPtr("latest"),
+		}
+	}
+	return &compute.ImageReference{
+		Publisher: to.StringPtr("Canonical"),
+		Offer:     to.StringPtr("UbuntuServer"),
+		Sku:       to.StringPtr("14.04.5-LTS"),
+		Version:   to.StringPtr("latest"),
+	}
+}
+
+// checkImageTerms looks up the image the VM is created from, in the given region, and, when it's sold through the marketplace under a plan,
+// ensures that the plan's terms were accepted for the subscription. It returns the plan to give the VM, or nil when the image has none.
+func checkImageTerms(subscriptionID uuid.UUID, location string, authorizer autorest.Authorizer) (plan *compute.Plan, err error) {
+	image := imageReference()
+	publisher, offer, sku, version := to.String(image.Publisher), to.String(image.Offer), to.String(image.Sku), to.String(image.Version)
+
+	images := compute.NewVirtualMachineImagesClient(subscriptionID.String())
+	images.Authorizer = authorizer
+	images.Sender = sender
+	images.PollingDelay = pollInterval
+
+	// The plan is a property of each version of an image, and "latest" isn't a version that can be looked up.
+	if strings.EqualFold(version, "latest") {
+		var versions compute.ListVirtualMachineImageResource
+		versions, err = images.List(location, publisher, offer, sku, "", to.Int32Ptr(1), "name desc")
+		if err != nil {
+			return nil, fmt.Errorf("could not list versions of image %s:%s:%s. Error: %v", publisher, offer, sku, err)
+		}
+		if versions.Value == nil || len(*versions.Value) == 0 {
+			return nil, fmt.Errorf("image %s:%s:%s isn't available in '%s'", publisher, offer, sku, location)
+		}
+		version = to.String((*versions.Value)[0].Name)
+	}
+
+	found, err := images.Get(location, publisher, offer, sku, version)
+	if err != nil {
+		return nil, fmt.Errorf("could not find image %s:%s:%s:%s. Error: %v", publisher, offer, sku, version, err)
+	}
+	if found.VirtualMachineImageProperties == nil || found.Plan == nil {
+		debugLog.Printf("Image %s:%s:%s:%s Has No Plan", publisher, offer, sku, version)
+		return nil, nil
+	}
+	purchase := found.Plan
+	urn := strings.Join([]string{publisher, offer, sku, version}, ":")
+
+	client := resources.NewGroupClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	agreementID := fmt.Sprintf("subscriptions/%s/providers/Microsoft.MarketplaceOrdering/offerTypes/virtualmachine/publishers/%s/offers/%s/plans/%s/agreements/current",
+		subscriptionID, to.String(purchase.Publisher), to.String(purchase.Product), to.String(purchase.Name))
+	req, err := client.GetByIDPreparer(agreementID)
+	if err != nil {
+		return
+	}
+
+	// As with data collection rule associations, the generic resource client's API version isn't one Microsoft.MarketplaceOrdering offers.
+	query := req.URL.Query()
+	query.Set("api-version", marketplaceAPIVersion)
+	req.URL.RawQuery = query.Encode()
+
+	resp, err := client.GetByIDSender(req)
+	if err != nil {
+		return
+	}
+	agreement, err := client.GetByIDResponder(resp)
+	if err != nil {
+		return nil, fmt.Errorf("could not check the terms of image %s. Error: %v", urn, err)
+	}
+
+	var accepted bool
+	if agreement.Properties != nil {
+		accepted, _ = (*agreement.Properties)["accepted"].(bool)
+	}
+	if !accepted {
+		return nil, fmt.Errorf("the terms of image %s haven't been accepted for subscription '%s', so a VM can't be created from it. Accept them by running `az vm image terms accept --urn %s --subscription %s`", urn, subscriptionID, urn, subscriptionID)
+	}
+	statusLog.Printf("Terms of Image Plan '%s' Were Accepted", to.String(purchase.Name))
+
+	return &compute.Plan{
+		Name:      purchase.Name,
+		Publisher: purchase.Publisher,
+		Product:   purchase.Product,
+	}, nil
+}
+
+// selectedIPForwarding is whether to enable IP forwarding on the VM's network interfaces, or nil to leave it to Azure, which disables it.
+func selectedIPForwarding() *bool {
+	if !ipForwarding {
+		return nil
+	}
+	return to.BoolPtr(true)
+}
+
+// selectedLicenseType is the -license-type to give the VM, or nil to leave its license to Azure.
+func selectedLicenseType() *string {
+	if licenseType == "" {
+		return nil
+	}
+	return to.StringPtr(licenseType)
+}
+
+// customScriptExtension describes the Linux CustomScript extension, configured to run a script inline.
+// The script is base64 encoded and passed through the "script" setting, which version 2 of the extension expects.
+func customScriptExtension(location *string, script []byte) compute.VirtualMachineExtension {
+	return compute.VirtualMachineExtension{
+		Name:     to.StringPtr("CustomScript"),
+		Location: location,
+		VirtualMachineExtensionProperties: &compute.VirtualMachineExtensionProperties{
+			AutoUpgradeMinorVersion: to.BoolPtr(autoUpgradeMinor),
+			Publisher:               to.StringPtr("Microsoft.Azure.Extensions"),
+			Type:                    to.StringPtr("CustomScript"),
+			TypeHandlerVersion:      to.StringPtr("2.0"),
+			Settings: &map[string]interface{}{
+				"script": base64.StdEncoding.EncodeToString(script),
+			},
+		},
+	}
+}
+
+// diskEncryptionExtension describes the Azure Disk Encryption extension for the selected operating system, configured to encrypt all
+// volumes using a key encryption key held in a Key Vault.
+func diskEncryptionExtension(location *string, keyVaultURL, keyEncryptionKeyID, aadClientSecret string) compute.VirtualMachineExtension {
+	encryptionType, encryptionVersion := "AzureDiskEncryptionForLinux", "0.1"
+	if osType == osWindows {
+		encryptionType, encryptionVersion = "AzureDiskEncryption", "1.1"
+	}
+
+	return compute.VirtualMachineExtension{
+		Name:     to.StringPtr(encryptionType),
+		Location: location,
+		VirtualMachineExtensionProperties: &compute.VirtualMachineExtensionProperties{
+			AutoUpgradeMinorVersion: to.BoolPtr(autoUpgradeMinor),
+			ProtectedSettings: selectedSettings(protectedObject, map[string]interface{}{
+				"AADClientSecret": aadClientSecret,  // The Secret that was created for the service principal secret.
+				"Passphrase":      "yourPassPhrase", // This sample uses a simple passphrase, but you should absolutely use something more sophisticated.
+			}),
+			Publisher: to.StringPtr("Microsoft.Azure.Security"),
+			Settings: selectedSettings(settingsObject, map[string]interface{}{
+				"AADClientID":               servicePrincipalApplicationID,
+				"EncryptionOperation":       "EnableEncryption",
+				"KeyEncryptionAlgorithm":    "RSA-OAEP",
+				"KeyEncryptionKeyAlgorithm": keyEncryptionKeyID,
+				"KeyVaultURL":               keyVaultURL,
+				"SequenceVersion":           uuid.NewV4().String(),
+				"VolumeType":                "ALL",
+			}),
+			Type:               to.StringPtr(encryptionType),
+			TypeHandlerVersion: selectedHandlerVersion(encryptionVersion),
+		},
+	}
+}
+
+// vmAccessExtension describes the VMAccess extension, which resets the password and, on Linux, the SSH key of the user chosen through the
+// -vmaccess-* flags. An empty password leaves the user's password unchanged.
+func vmAccessExtension(location *string, password string) compute.VirtualMachineExtension {
+	if osType == osWindows {
+		return compute.VirtualMachineExtension{
+			Name:     to.StringPtr("VMAccessAgent"),
+			Location: location,
+			VirtualMachineExtensionProperties: &compute.VirtualMachineExtensionProperties{
+				AutoUpgradeMinorVersion: to.BoolPtr(autoUpgradeMinor),
+				Publisher:               to.StringPtr("Microsoft.Compute"),
+				Type:                    to.StringPtr("VMAccessAgent"),
+				TypeHandlerVersion:      selectedHandlerVersion("2.0"),
+				Settings: selectedSettings(settingsObject, map[string]interface{}{
+					"UserName": accessUsername,
+				}),
+				ProtectedSettings: selectedSettings(protectedObject, map[string]interface{}{
+					"Password": password,
+				}),
 			},
-			NetworkProfile: &compute.NetworkProfile{
-				NetworkInterfaces: &[]compute.NetworkInterfaceReference{
-					{
-						ID: networkCard.ID,
-						NetworkInterfaceReferenceProperties: &compute.NetworkInterfaceReferenceProperties{
-							Primary: to.BoolPtr(true),
-						},
+		}
+	}
+
+	credentials := map[string]interface{}{
+		"username": accessUsername,
+	}
+	if password != "" {
+		credentials["password"] = password
+	}
+	if accessKey != "" {
+		credentials["ssh_key"] = accessKey
+	}
+
+	return compute.VirtualMachineExtension{
+		Name:     to.StringPtr("VMAccessForLinux"),
+		Location: location,
+		VirtualMachineExtensionProperties: &compute.VirtualMachineExtensionProperties{
+			AutoUpgradeMinorVersion: to.BoolPtr(autoUpgradeMinor),
+			Publisher:               to.StringPtr("Microsoft.OSTCExtensions"),
+			Type:                    to.StringPtr("VMAccessForLinux"),
+			TypeHandlerVersion:      selectedHandlerVersion("1.4"),
+			Settings:                selectedSettings(settingsObject, nil),
+			ProtectedSettings:       selectedSettings(protectedObject, credentials),
+		},
+	}
+}
+
+// monitorAgentExtension describes the Azure Monitor agent extension for the selected operating system. The agent authenticates with the
+// VM's system assigned identity, which vmIdentity gives the VM whenever this extension is chosen.
+func monitorAgentExtension(location *string) compute.VirtualMachineExtension {
+	extensionName := "AzureMonitorLinuxAgent"
+	if osType == osWindows {
+		extensionName = "AzureMonitorWindowsAgent"
+	}
+
+	return compute.VirtualMachineExtension{
+		Name:     to.StringPtr(extensionName),
+		Location: location,
+		VirtualMachineExtensionProperties: &compute.VirtualMachineExtensionProperties{
+			AutoUpgradeMinorVersion: to.BoolPtr(autoUpgradeMinor),
+			Publisher:               to.StringPtr("Microsoft.Azure.Monitor"),
+			Type:                    to.StringPtr(extensionName),
+			TypeHandlerVersion:      selectedHandlerVersion("1.0"),
+			Settings:                selectedSettings(settingsObject, nil),
+			ProtectedSettings:       selectedSettings(protectedObject, nil),
+		},
+	}
+}
+
+// vmIdentity is the identity to give the sample's VM: a system assigned identity when an extension that needs one is chosen, otherwise nil.
+func vmIdentity() *compute.VirtualMachineIdentity {
+	if !extensionTypes.contains(extensionMonitorAgent) {
+		return nil
+	}
+	return &compute.VirtualMachineIdentity{Type: compute.SystemAssigned}
+}
+
+// associateDataCollectionRule points the Azure Monitor agent on a VM at a data collection rule, by creating a data collection rule association
+// on the VM.
+func associateDataCollectionRule(subscriptionID uuid.UUID, vm compute.VirtualMachine, ruleID string, authorizer autorest.Authorizer) (err error) {
+	client := resources.NewGroupClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	associationID := fmt.Sprintf("%s/providers/%s/dataCollectionRuleAssociations/sample-dcr-association", strings.TrimPrefix(*vm.ID, "/"), insightsProvider)
+	req, err := client.CreateOrUpdateByIDPreparer(associationID, resources.GenericResource{
+		Properties: &map[string]interface{}{
+			"dataCollectionRuleId": ruleID,
+		},
+	}, nil)
+	if err != nil {
+		return
+	}
+
+	// The generic resource client pins its own API version, which Microsoft.Insights doesn't offer for associations.
+	query := req.URL.Query()
+	query.Set("api-version", dataCollectionAPIVersion)
+	req.URL.RawQuery = query.Encode()
+
+	resp, err := client.CreateOrUpdateByIDSender(req)
+	if err != nil {
+		return
+	}
+	_, err = client.CreateOrUpdateByIDResponder(resp)
+	return
+}
+
+// checkUsername ensures that Azure will accept name for an account on the VM's operating system.
+func checkUsername(name string) error {
+	if name == "" {
+		return errors.New("the user name must not be empty")
+	}
+	if maxLength, ok := maxUsernameLength[osType]; ok && len(name) > maxLength {
+		return fmt.Errorf("user name '%s' is %d characters long, but may be at most %d on %s", name, len(name), maxLength, osType)
+	}
+	if osType == osWindows && strings.HasSuffix(name, ".") {
+		return fmt.Errorf("user name '%s' may not end with '.' on %s", name, osType)
+	}
+	for _, reserved := range reservedUsernames[osType] {
+		if strings.EqualFold(name, reserved) {
+			return fmt.Errorf("user name '%s' is reserved on %s. Azure doesn't allow any of: %s", name, osType, strings.Join(reservedUsernames[osType], ", "))
+		}
+	}
+	return nil
+}
+
+// readAccessCredentials validates the credentials provided through the -vmaccess-* flags against the rules of the VM's operating system,
+// and reads the public SSH key, if there is one.
+func readAccessCredentials() error {
+	if err := checkUsername(accessUsername); err != nil {
+		return fmt.Errorf("-vmaccess-username is not valid. Error: %v", err)
+	}
+
+	if accessKeyFile != "" {
+		if osType != osLinux {
+			return errors.New("-vmaccess-ssh-key-file may only be used with -os linux")
+		}
+		contents, err := ioutil.ReadFile(accessKeyFile)
+		if err != nil {
+			return fmt.Errorf("could not read SSH key file '%s'. Error: %v", accessKeyFile, err)
+		}
+		accessKey = strings.TrimSpace(string(contents))
+		if !strings.HasPrefix(accessKey, "ssh-rsa ") {
+			return fmt.Errorf("'%s' doesn't look like a public SSH key. Azure expects an OpenSSH formatted RSA key, starting with 'ssh-rsa'", accessKeyFile)
+		}
+	}
+
+	if accessPassword == "" {
+		// A protected settings file replaces the credentials the flags would have provided.
+		if protectedFile != "" {
+			return nil
+		}
+		if osType == osWindows {
+			return errors.New("-extension-type vmaccess requires -vmaccess-password on Windows")
+		}
+		if accessKey == "" {
+			return errors.New("-extension-type vmaccess requires -vmaccess-password, -vmaccess-ssh-key-file, or both")
+		}
+		return nil
+	}
+
+	bounds := adminPasswordLength[osType]
+	if len(accessPassword) < bounds[0] || len(accessPassword) > bounds[1] {
+		return fmt.Errorf("-vmaccess-password must be between %d and %d characters long on %s", bounds[0], bounds[1], osType)
+	}
+
+	var lower, upper, digit, special bool
+	for _, r := range accessPassword {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			special = true
+		}
+	}
+	var classes int
+	for _, present := range []bool{lower, upper, digit, special} {
+		if present {
+			classes++
+		}
+	}
+	if classes < 3 {
+		return errors.New("-vmaccess-password must contain at least three of: a lowercase letter, an uppercase letter, a digit, and a special character")
+	}
+	return nil
+}
+
+// checkHandlerVersion warns when -handler-version has a major version that the extension chosen with -extension-type isn't known to support.
+func checkHandlerVersion() {
+	extensionName := extensionTypeNames[extensionTypes[0]][osType]
+
+	major := strings.SplitN(handlerVersion, ".", 2)[0]
+	for _, compatible := range compatibleHandlerMajors[extensionName] {
+		if major == compatible {
+			return
+		}
+	}
+	warnLog.Printf("%s has no known handler versions starting with '%s.'. Provisioning may fail. Known major versions: %s", extensionName, major, strings.Join(compatibleHandlerMajors[extensionName], ", "))
+}
+
+// selectedHandlerVersion is the handler version to use for the extension chosen with -extension-type, preferring -handler-version over
+// the given default.
+func selectedHandlerVersion(defaultVersion string) *string {
+	if handlerVersion != "" {
+		return to.StringPtr(handlerVersion)
+	}
+	return to.StringPtr(defaultVersion)
+}
+
+// extensionList collects the extensions chosen through repeated uses of the -extension flag, in order.
+type extensionList []string
+
+func (list *extensionList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *extensionList) Set(value string) error {
+	value = strings.ToLower(value)
+	if !isSupportedExtension(value) {
+		return fmt.Errorf("'%s' is not a supported extension type. This sample expects one of: %s", value, strings.Join(supportedExtensionTypes, ", "))
+	}
+	if list.contains(value) {
+		return fmt.Errorf("the %s extension may only be installed once", value)
+	}
+	*list = append(*list, value)
+	return nil
+}
+
+// certificateList collects the certificates chosen through repeated uses of the -certificate-url flag, in order.
+type certificateList []string
+
+func (list *certificateList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *certificateList) Set(value string) error {
+	if _, err := parseCertificateURL(value); err != nil {
+		return err
+	}
+	*list = append(*list, value)
+	return nil
+}
+
+// parseCertificateURL ensures that raw is the URL of a specific version of a Key Vault secret, as a VM's OS profile requires, and finds the
+// name of the vault it's stored in.
+func parseCertificateURL(raw string) (vaultName string, err error) {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Scheme != "https" || !strings.HasSuffix(strings.ToLower(parsed.Host), "."+environment.KeyVaultDNSSuffix) {
+		return "", fmt.Errorf("'%s' is not a Key Vault URL. This sample expects a URL of the form https://{vault}.%s/secrets/{name}/{version}", raw, environment.KeyVaultDNSSuffix)
+	}
+	if segments := strings.Split(strings.Trim(parsed.Path, "/"), "/"); len(segments) != 3 || segments[0] != "secrets" {
+		return "", fmt.Errorf("'%s' is not the URL of a version of a secret. This sample expects a URL of the form https://{vault}.%s/secrets/{name}/{version}", raw, environment.KeyVaultDNSSuffix)
+	}
+	return strings.TrimSuffix(strings.ToLower(parsed.Host), "."+environment.KeyVaultDNSSuffix), nil
+}
+
+// tagKinds are the kinds of resource that -tag can be limited to.
+var tagKinds = []string{"rg", "vm", "nic", "vnet", "nsg", "pip", "storage", "vault", "disk"}
+
+// templateTagKinds maps the types of resource in the exported template to the kind of resource whose tags they're given.
+var templateTagKinds = map[string]string{
+	"Microsoft.Compute/virtualMachines":       "vm",
+	"Microsoft.Compute/disks":                 "disk",
+	"Microsoft.Network/networkInterfaces":     "nic",
+	"Microsoft.Network/virtualNetworks":       "vnet",
+	"Microsoft.Network/networkSecurityGroups": "nsg",
+	"Microsoft.Network/publicIPAddresses":     "pip",
+	"Microsoft.Storage/storageAccounts":       "storage",
+}
+
+// The limits Azure places on tags.
+const (
+	maxTags           = 50
+	maxTagNameLength  = 512
+	maxTagValueLength = 256
+)
+
+// tagSets collects the tags chosen through repeated uses of the -tag flag, by the kind of resource they're limited to. Tags given to all
+// resources are kept under the empty kind.
+type tagSets map[string]map[string]string
+
+func (sets *tagSets) String() string {
+	if sets == nil {
+		return ""
+	}
+	var given []string
+	for kind, tags := range *sets {
+		for key, value := range tags {
+			if kind != "" {
+				key = kind + ":" + key
+			}
+			given = append(given, key+"="+value)
+		}
+	}
+	sort.Strings(given)
+	return strings.Join(given, ",")
+}
+
+func (sets *tagSets) Set(value string) error {
+	pair := strings.SplitN(value, "=", 2)
+	if len(pair) != 2 {
+		return fmt.Errorf("'%s' is not a tag. This sample expects a tag of the form key=value, or kind:key=value", value)
+	}
+	key, tagValue := pair[0], pair[1]
+
+	var kind string
+	if i := strings.Index(key, ":"); i >= 0 {
+		kind, key = strings.ToLower(key[:i]), key[i+1:]
+		if !extensionList(tagKinds).contains(kind) {
+			return fmt.Errorf("'%s' is not a kind of resource that can be tagged. This sample expects one of: %s", kind, strings.Join(tagKinds, ", "))
+		}
+	}
+
+	switch {
+	case key == "":
+		return fmt.Errorf("tag '%s' has no name", value)
+	case len(key) > maxTagNameLength:
+		return fmt.Errorf("tag name '%s' is %d characters long, but may be at most %d", key, len(key), maxTagNameLength)
+	case strings.ContainsAny(key, `<>%&\?/`):
+		return fmt.Errorf("tag name '%s' may not contain any of: < > %% & \\ ? /", key)
+	case len(tagValue) > maxTagValueLength:
+		return fmt.Errorf("the value of tag '%s' is %d characters long, but may be at most %d", key, len(tagValue), maxTagValueLength)
+	}
+
+	if *sets == nil {
+		*sets = tagSets{}
+	}
+	if (*sets)[kind] == nil {
+		(*sets)[kind] = map[string]string{}
+	}
+	(*sets)[kind][key] = tagValue
+	return nil
+}
+
+// resourceTags merges the tags given to every resource with those given to the provided kind of resource, which take precedence. It is nil
+// when there are no tags to give.
+func resourceTags(kind string) *map[string]*string {
+	merged := map[string]*string{}
+	for _, scope := range []string{"", kind} {
+		for key, value := range resourceTagSets[scope] {
+			merged[key] = to.StringPtr(value)
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	return &merged
+}
+
+// isSupportedExtension determines whether value is one of supportedExtensionTypes.
+func isSupportedExtension(value string) bool {
+	return extensionList(supportedExtensionTypes).contains(value)
+}
+
+func (list extensionList) contains(value string) bool {
+	for _, current := range list {
+		if current == value {
+			return true
+		}
+	}
+	return false
+}
+
+// selectedSettings is the settings object to use for the extension chosen with -extension-type, preferring one read from a file over
+// the given defaults. It is nil when neither is available.
+func selectedSettings(fromFile, defaults map[string]interface{}) *map[string]interface{} {
+	if fromFile != nil {
+		return &fromFile
+	}
+	if defaults != nil {
+		return &defaults
+	}
+	return nil
+}
+
+// readJSONObject reads a file that must hold a single JSON object.
+func readJSONObject(path string) (parsed map[string]interface{}, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read settings file '%s'. Error: %v", path, err)
+	}
+	if err = json.Unmarshal(contents, &parsed); err != nil || parsed == nil {
+		return nil, fmt.Errorf("settings file '%s' must hold a JSON object", path)
+	}
+	return
+}
+
+func setupServicePrincipal(tenantID uuid.UUID, authToken adal.Token) (<-chan graphrbac.ServicePrincipal, <-chan error, func() error) {
+	results, errs := make(chan graphrbac.ServicePrincipal, 1), make(chan error, 1)
+
+	deleter := func() (retval func() error) {
+		var spt *adal.ServicePrincipalToken
+		var config *adal.OAuthConfig
+		var err error
+		var result graphrbac.ServicePrincipal
+
+		retval = func() error { return nil }
+
+		defer close(errs)
+		defer close(results)
+
+		config, err = adal.NewOAuthConfig(environment.ActiveDirectoryEndpoint, tenantID.String())
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		spt, err = adal.NewServicePrincipalTokenFromManualToken(*config, userClientID.String(), environment.GraphEndpoint, authToken)
+		if err != nil {
+			errs <- err
+			return
+		}
+		spt.SetSender(sender)
+
+		client := graphrbac.NewServicePrincipalsClient(tenantID.String())
+		client.Authorizer = autorest.NewBearerAuthorizer(spt)
+		client.Sender = sender
+		client.PollingDelay = pollInterval
+
+		result, err = client.Create(graphrbac.ServicePrincipalCreateParameters{
+			AccountEnabled: to.BoolPtr(false),
+		})
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		results <- result
+		retval = func() (delErr error) {
+			_, delErr = client.Delete(*result.ObjectID)
+			return
+		}
+		return
+	}()
+
+	return results, errs, deleter
+}
+
+func setupVirtualNetwork(subscriptionID uuid.UUID, resourceGroup resources.Group, securityGroup *network.SecurityGroup, authorizer autorest.Authorizer) (<-chan network.VirtualNetwork, <-chan error) {
+	results, errs := make(chan network.VirtualNetwork, 1), make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(results)
+
+		var tempErrs <-chan error
+		var created network.VirtualNetwork
+		var err error
+
+		networkClient := network.NewVirtualNetworksClient(subscriptionID.String())
+		networkClient.Authorizer = authorizer
+		networkClient.Sender = sender
+		networkClient.PollingDelay = pollInterval
+
+		const networkName = "sampleNetwork"
+
+		_, tempErrs = networkClient.CreateOrUpdate(*resourceGroup.Name, networkName, network.VirtualNetwork{
+			Location: resourceGroup.Location,
+			Tags:     resourceTags("vnet"),
+			VirtualNetworkPropertiesFormat: &network.VirtualNetworkPropertiesFormat{
+				AddressSpace: &network.AddressSpace{
+					AddressPrefixes: &[]string{
+						"192.168.0.0/16",
 					},
 				},
 			},
-			OsProfile: &compute.OSProfile{
-				ComputerName:  to.StringPtr(vmName),
-				AdminUsername: to.StringPtr("sampleuser"),
-				AdminPassword: to.StringPtr("azureRocksWithGo!"),
-				LinuxConfiguration: &compute.LinuxConfiguration{
-					DisablePasswordAuthentication: to.BoolPtr(false),
-				},
-			},
-			StorageProfile: &compute.StorageProfile{
-				ImageReference: &compute.ImageReference{
-					Publisher: to.StringPtr("Canonical"),
-					Offer:     to.StringPtr("UbuntuServer"),
-					Sku:       to.StringPtr("14.04.5-LTS"),
-					Version:   to.StringPtr("latest"),
-				},
-				OsDisk: &compute.OSDisk{
-					CreateOption: compute.FromImage,
-					DiskSizeGB:   to.Int32Ptr(64),
-				},
-				DataDisks: &[]compute.DataDisk{
-					{
-						CreateOption: compute.Attach,
-						Lun:          to.Int32Ptr(0),
-						ManagedDisk: &compute.ManagedDiskParameters{
-							ID:                 dataDisk.ID,
-							StorageAccountType: compute.StorageAccountTypes(storageAccount.Sku.Name),
-						},
-					},
-				},
+		}, nil)
+		if err = <-tempErrs; err != nil {
+			errs <- err
+			return
+		}
+
+		subnetClient := network.NewSubnetsClient(subscriptionID.String())
+		subnetClient.Authorizer = authorizer
+		subnetClient.Sender = sender
+		subnetClient.PollingDelay = pollInterval
+
+		const subnetName = "sampleSubnet"
+
+		_, tempErrs = subnetClient.CreateOrUpdate(*resourceGroup.Name, networkName, "sampleSubnet", network.Subnet{
+			SubnetPropertiesFormat: &network.SubnetPropertiesFormat{
+				AddressPrefix:        to.StringPtr("192.168.1.0/24"),
+				NetworkSecurityGroup: securityGroup,
 			},
-		},
-	}, cancel)
-	if err = <-createErrs; err != nil {
+		}, nil)
+
+		if err = <-tempErrs; err != nil {
+			errs <- err
+			return
+		}
+
+		created, err = networkClient.Get(*resourceGroup.Name, networkName, "")
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		results <- created
+	}()
+
+	return results, errs
+}
+
+// getSubnet looks up an existing subnet for the VM to be put in, ensuring that it is in the region the VM will be created in and that it
+// has addresses to give the VM.
+func getSubnet(subscriptionID uuid.UUID, group, networkName, subnetName string, authorizer autorest.Authorizer) (found network.Subnet, err error) {
+	networkClient := network.NewVirtualNetworksClient(subscriptionID.String())
+	networkClient.Authorizer = authorizer
+	networkClient.Sender = sender
+	networkClient.PollingDelay = pollInterval
+
+	existing, err := networkClient.Get(group, networkName, "")
+	if err != nil {
+		if missing, ok := serviceError(err); ok && missing.Code == "ResourceNotFound" {
+			err = fmt.Errorf("there is no Virtual Network named '%s' in resource group '%s'", networkName, group)
+		}
+		return
+	}
+	squash := func(name string) string {
+		return strings.ToLower(strings.Replace(name, " ", "", -1))
+	}
+	if squash(to.String(existing.Location)) != squash(location) {
+		err = fmt.Errorf("virtual network '%s' is in %s, but the VM must be in the same region as its network, and will be created in %s", networkName, to.String(existing.Location), location)
 		return
 	}
 
-	created, err = client.Get(*resourceGroup.Name, vmName, "")
+	subnetClient := network.NewSubnetsClient(subscriptionID.String())
+	subnetClient.Authorizer = authorizer
+	subnetClient.Sender = sender
+	subnetClient.PollingDelay = pollInterval
+
+	found, err = subnetClient.Get(group, networkName, subnetName, "")
+	if err != nil {
+		if missing, ok := serviceError(err); ok && (missing.Code == "NotFound" || missing.Code == "ResourceNotFound") {
+			err = fmt.Errorf("virtual network '%s' has no subnet named '%s'", networkName, subnetName)
+		}
+		return
+	}
+	if found.SubnetPropertiesFormat == nil || to.String(found.AddressPrefix) == "" {
+		err = fmt.Errorf("subnet '%s' of virtual network '%s' has no address prefix to give the VM an address from", subnetName, networkName)
+	}
 	return
 }
 
-func setupServicePrincipal(tenantID uuid.UUID, authToken adal.Token) (<-chan graphrbac.ServicePrincipal, <-chan error, func() error) {
-	results, errs := make(chan graphrbac.ServicePrincipal, 1), make(chan error, 1)
+// setupNetworkInterface creates one of the network interfaces attached to the sample's VM. Only the first interface, at index 0, is given a
+// Public IP Address and Load Balancer membership; any others only have a private IP in the provided subnet. A nil securityGroup leaves the
+// interface without a Network Security Group of its own.
+func setupNetworkInterface(client nicCreator, subscriptionID uuid.UUID, resourceGroup resources.Group, subnet network.Subnet, machine network.SubResource, index int, securityGroup *network.SecurityGroup, authorizer autorest.Authorizer) (created network.Interface, err error) {
+	var ipConfig network.InterfaceIPConfiguration
+	ipConfig, err = setupIPConfiguration(subscriptionID, resourceGroup, subnet, fmt.Sprintf("ipConfig-%s", *machine.ID), index == 0, authorizer)
+	if err != nil {
+		return
+	}
 
-	deleter := func() (retval func() error) {
-		var spt *adal.ServicePrincipalToken
-		var config *adal.OAuthConfig
-		var err error
-		var result graphrbac.ServicePrincipal
+	name := resourceName(naming.NICName(index))
 
-		retval = func() error { return nil }
+	_, errs := client.CreateOrUpdate(*resourceGroup.Name, name, network.Interface{
+		Location: resourceGroup.Location,
+		Tags:     resourceTags("nic"),
+		InterfacePropertiesFormat: &network.InterfacePropertiesFormat{
+			IPConfigurations:     &[]network.InterfaceIPConfiguration{ipConfig},
+			NetworkSecurityGroup: securityGroup,
+			EnableIPForwarding:   selectedIPForwarding(),
+		},
+	}, nil)
+	if err = <-errs; err != nil {
+		return
+	}
 
-		defer close(errs)
-		defer close(results)
+	err = withRetry(func() (getErr error) {
+		created, getErr = client.Get(*resourceGroup.Name, name, "")
+		return
+	})
 
-		config, err = adal.NewOAuthConfig(environment.ActiveDirectoryEndpoint, tenantID.String())
+	return
+}
+
+// setupIPConfiguration builds the primary IP configuration of one of the sample's network interfaces. It has a dynamically allocated private IP
+// in the provided subnet, and, for the VM's primary interface and depending on the flags this sample was run with, a new or existing Public IP
+// Address and membership in a Load Balancer backend pool. Any Public IP Address that is needed is created here.
+func setupIPConfiguration(subscriptionID uuid.UUID, resourceGroup resources.Group, subnet network.Subnet, name string, primary bool, authorizer autorest.Authorizer) (created network.InterfaceIPConfiguration, err error) {
+	var ip *network.PublicIPAddress
+
+	switch {
+	case !primary:
+		// Only the VM's primary network interface is reachable from outside its Virtual Network.
+	case noPublicIP:
+		statusLog.Print("Skipping Public IP Address")
+	case publicIPID != "":
+		var existing network.PublicIPAddress
+		existing, err = getPublicIP(publicIPID, resourceGroup, authorizer)
+		if err != nil {
+			return
+		}
+		statusLog.Print("Using Existing Public IP Address: ", *existing.Name, " ", to.String(existing.IPAddress))
+		summary.address = to.String(existing.IPAddress)
+		ip = &existing
+	default:
+		var fresh network.PublicIPAddress
+		fresh, err = setupPublicIP(subscriptionID, resourceGroup, authorizer)
 		if err != nil {
-			errs <- err
 			return
 		}
+		statusLog.Print("Created Public IP Address: ", *fresh.Name, " ", *fresh.IPAddress)
+		summary.addResource("Public IP Address", *fresh.Name)
+		summary.address = *fresh.IPAddress
+		if fresh.DNSSettings != nil && fresh.DNSSettings.Fqdn != nil {
+			statusLog.Print("VM FQDN: ", *fresh.DNSSettings.Fqdn)
+			summary.fqdn = *fresh.DNSSettings.Fqdn
+		}
+		ip = &fresh
+	}
 
-		spt, err = adal.NewServicePrincipalTokenFromManualToken(*config, userClientID.String(), environment.GraphEndpoint, authToken)
+	var backendPools *[]network.BackendAddressPool
+	if primary && lbBackendPoolID != "" {
+		var pool network.BackendAddressPool
+		pool, err = getBackendAddressPool(lbBackendPoolID, authorizer)
 		if err != nil {
-			errs <- err
 			return
 		}
+		debugLog.Print("Joining Load Balancer Backend Pool: ", *pool.ID)
+		backendPools = &[]network.BackendAddressPool{{ID: pool.ID}}
+	}
 
-		client := graphrbac.NewServicePrincipalsClient(tenantID.String())
-		client.Authorizer = autorest.NewBearerAuthorizer(spt)
+	created = network.InterfaceIPConfiguration{
+		Name: to.StringPtr(name),
+		InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
+			PrivateIPAllocationMethod:       network.Dynamic,
+			Primary:                         to.BoolPtr(true),
+			PublicIPAddress:                 ip,
+			Subnet:                          &subnet,
+			LoadBalancerBackendAddressPools: backendPools,
+		},
+	}
+	return
+}
 
-		result, err = client.Create(graphrbac.ServicePrincipalCreateParameters{
-			AccountEnabled: to.BoolPtr(false),
+// getBackendAddressPool fetches an existing Load Balancer backend address pool, ensuring that both the Load Balancer and the pool exist.
+func getBackendAddressPool(poolID string, authorizer autorest.Authorizer) (pool network.BackendAddressPool, err error) {
+	matches := lbBackendPoolPattern.FindStringSubmatch(poolID)
+	if matches == nil {
+		err = fmt.Errorf("'%s' is not a Load Balancer backend address pool ID", poolID)
+		return
+	}
+	subscriptionID, groupName, lbName, poolName := matches[1], matches[2], matches[3], matches[4]
+
+	client := network.NewLoadBalancersClient(subscriptionID)
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	var lb network.LoadBalancer
+	lb, err = client.Get(groupName, lbName, "")
+	if err != nil {
+		return
+	}
+
+	if lb.LoadBalancerPropertiesFormat != nil && lb.BackendAddressPools != nil {
+		for _, candidate := range *lb.BackendAddressPools {
+			if candidate.Name != nil && strings.EqualFold(*candidate.Name, poolName) {
+				pool = candidate
+				return
+			}
+		}
+	}
+
+	err = fmt.Errorf("load balancer '%s' has no backend address pool named '%s'", lbName, poolName)
+	return
+}
+
+func setupNetworkSecurityGroup(subscriptionID, resourceGroupName string, authorizer autorest.Authorizer) (created network.SecurityGroup, err error) {
+	client := network.NewSecurityGroupsClient(subscriptionID)
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	name := "sample-nsg"
+
+	results, errs := client.CreateOrUpdate(resourceGroupName, name, network.SecurityGroup{
+		Location:                      to.StringPtr(location),
+		Tags:                          resourceTags("nsg"),
+		SecurityGroupPropertiesFormat: &network.SecurityGroupPropertiesFormat{},
+	}, nil)
+	created, err = <-results, <-errs
+	return
+}
+
+// setupFlowLogs has the Network Watcher for the Resource Group's region log the traffic flowing through a Network Security Group to a
+// Storage Account. Azure allows one Network Watcher per region in each subscription, so an existing one is used if there is one.
+// Otherwise, one is created in the provided Resource Group.
+func setupFlowLogs(subscriptionID uuid.UUID, group resources.Group, securityGroup network.SecurityGroup, account storage.Account, authorizer autorest.Authorizer) (err error) {
+	client := network.NewWatchersClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	var watcher network.Watcher
+	var existing network.WatcherListResult
+	existing, err = client.ListAll()
+	if err != nil {
+		return
+	}
+	if existing.Value != nil {
+		for _, candidate := range *existing.Value {
+			if strings.EqualFold(to.String(candidate.Location), *group.Location) {
+				watcher = candidate
+				break
+			}
+		}
+	}
+
+	var watcherGroup string
+	if watcher.ID != nil {
+		matches := resourceGroupPattern.FindStringSubmatch(*watcher.ID)
+		if matches == nil {
+			err = fmt.Errorf("could not find the Resource Group of Network Watcher '%s'", *watcher.ID)
+			return
+		}
+		watcherGroup = matches[1]
+		debugLog.Print("Using Existing Network Watcher: ", *watcher.ID)
+	} else {
+		watcherGroup = *group.Name
+		watcher, err = client.CreateOrUpdate(watcherGroup, "sample-networkwatcher", network.Watcher{
+			Location: group.Location,
 		})
 		if err != nil {
-			errs <- err
 			return
 		}
+		statusLog.Print("Created Network Watcher: ", *watcher.Name)
+	}
 
-		results <- result
-		retval = func() (delErr error) {
-			_, delErr = client.Delete(*result.ObjectID)
+	_, errs := client.SetFlowLogConfiguration(watcherGroup, *watcher.Name, network.FlowLogInformation{
+		TargetResourceID: securityGroup.ID,
+		FlowLogProperties: &network.FlowLogProperties{
+			StorageID: account.ID,
+			Enabled:   to.BoolPtr(true),
+		},
+	}, nil)
+	err = <-errs
+	return
+}
+
+// parseCachingType finds the disk caching mode named by value, ignoring case.
+func parseCachingType(value string) (compute.CachingTypes, bool) {
+	for _, candidate := range []compute.CachingTypes{compute.None, compute.ReadOnly, compute.ReadWrite} {
+		if strings.EqualFold(value, string(candidate)) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// resourceName applies -name-prefix and -name-suffix to the name this sample would otherwise give a resource.
+func resourceName(name string) string {
+	return namePrefix + name + nameSuffix
+}
+
+// validate ensures that name is acceptable to Azure for the type of resource described by rule.
+func (rule nameRule) validate(name string) error {
+	if len(name) > rule.maxLength {
+		return fmt.Errorf("'%s' is %d characters long, but may be at most %d", name, len(name), rule.maxLength)
+	}
+	if !rule.pattern.MatchString(name) {
+		return fmt.Errorf("'%s' contains characters that aren't allowed, or starts or ends with one that isn't", name)
+	}
+	return nil
+}
+
+// getPublicIP fetches an existing Public IP Address, ensuring that it can be assigned to a network interface in the provided Resource Group.
+func getPublicIP(id string, group resources.Group, authorizer autorest.Authorizer) (ip network.PublicIPAddress, err error) {
+	matches := publicIPPattern.FindStringSubmatch(id)
+	if matches == nil {
+		err = fmt.Errorf("'%s' is not a Public IP Address ID", id)
+		return
+	}
+	subscriptionID, groupName, name := matches[1], matches[2], matches[3]
+
+	client := network.NewPublicIPAddressesClient(subscriptionID)
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	ip, err = client.Get(groupName, name, "")
+	if err != nil {
+		return
+	}
+
+	if ip.Location != nil && group.Location != nil && !strings.EqualFold(*ip.Location, *group.Location) {
+		err = fmt.Errorf("public IP address '%s' is in '%s', but must be in '%s' to be assigned to this sample's VM", name, *ip.Location, *group.Location)
+		return
+	}
+	if ip.PublicIPAddressPropertiesFormat != nil && ip.IPConfiguration != nil {
+		err = fmt.Errorf("public IP address '%s' is already assigned to '%s'", name, to.String(ip.IPConfiguration.ID))
+		return
+	}
+	return
+}
+
+func setupPublicIP(subscriptionID uuid.UUID, group resources.Group, authorizer autorest.Authorizer) (created network.PublicIPAddress, err error) {
+	client := network.NewPublicIPAddressesClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	name := resourceName("sample-publicip")
+
+	var dnsSettings *network.PublicIPAddressDNSSettings
+	if dnsLabel != "" {
+		dnsSettings = &network.PublicIPAddressDNSSettings{
+			DomainNameLabel: to.StringPtr(dnsLabel),
+		}
+	}
+
+	_, errs := client.CreateOrUpdate(*group.Name, name, network.PublicIPAddress{
+		Location: group.Location,
+		Tags:     resourceTags("pip"),
+		PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
+			PublicIPAllocationMethod: network.Static,
+			DNSSettings:              dnsSettings,
+		},
+	}, nil)
+
+	if err = <-errs; err != nil {
+		return
+	}
+
+	created, err = client.Get(*group.Name, name, "")
+	return
+}
+
+// checkNameAvailability ensures that the names this run gives to resources whose names are unique across Azure are free: the Storage
+// Account's, and the Public IP Address's DNS label, in the given region, when -dns-label was given.
+func checkNameAvailability(subscriptionID uuid.UUID, location, storageName string, authorizer autorest.Authorizer) (err error) {
+	accounts := storage.NewAccountsClient(subscriptionID.String())
+	accounts.Authorizer = authorizer
+	accounts.Sender = sender
+	accounts.PollingDelay = pollInterval
+
+	result, err := accounts.CheckNameAvailability(storage.AccountCheckNameAvailabilityParameters{
+		Name: to.StringPtr(storageName),
+		Type: to.StringPtr("Microsoft.Storage/storageAccounts"),
+	})
+	if err != nil {
+		return fmt.Errorf("could not check the availability of Storage Account name '%s'. Error: %v", storageName, err)
+	}
+	if !to.Bool(result.NameAvailable) {
+		if result.Reason == storage.AlreadyExists {
+			return fmt.Errorf("storage account name '%s' is already taken. Run the sample again to choose another", storageName)
+		}
+		return fmt.Errorf("storage account name '%s' can't be used: %s", storageName, to.String(result.Message))
+	}
+
+	if dnsLabel == "" {
+		return nil
+	}
+
+	client := network.New(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	label, err := client.CheckDNSNameAvailability(location, dnsLabel)
+	if err != nil {
+		return fmt.Errorf("could not check the availability of DNS label '%s'. Error: %v", dnsLabel, err)
+	}
+	if !to.Bool(label.Available) {
+		return fmt.Errorf("DNS label '%s' is already taken in %s. Choose another with -dns-label", dnsLabel, location)
+	}
+	return nil
+}
+
+// storageAccountName chooses a name for the sample's Storage Account, which must be unique across Azure.
+func storageAccountName() string {
+	return strings.ToLower("sample" + string([]byte(uuid.NewV4().String())[:8]))
+}
+
+func setupStorageAccount(subscriptionID uuid.UUID, group resources.Group, name string, authorizer autorest.Authorizer) (<-chan storage.Account, <-chan error) {
+	client := storage.NewAccountsClient(subscriptionID.String())
+	client.Authorizer = authorizer
+	client.Sender = sender
+	client.PollingDelay = pollInterval
+
+	return client.Create(*group.Name, name, storage.AccountCreateParameters{
+		Location: group.Location,
+		Tags:     resourceTags("storage"),
+		Sku: &storage.Sku{
+			Name: storage.StandardLRS,
+		},
+	}, nil)
+}
+
+// authenticate gets an authorization token to allow clients to access Azure assets.
+func authenticate(ctx context.Context, clientID uuid.UUID) (token *adal.Token, err error) {
+	// adal reports sign-in failures without the AADSTS codes that explain them, so hold on to the last failure Azure AD described.
+	var rejection adal.TokenError
+	authClient := autorest.NewClientWithUserAgent("github.com/Azure-Samples/arm-compute-go-vm-extensions")
+	authClient.Sender = autorest.DecorateSender(sender, withTokenErrors(&rejection))
+	authClient.PollingDelay = pollInterval
+	var deviceCode *adal.DeviceCode
+	var config *adal.OAuthConfig
+
+	config, err = adal.NewOAuthConfig(environment.ActiveDirectoryEndpoint, "common")
+	if err != nil {
+		return
+	}
+
+	// Device code sign-in can't complete unless someone sees the code. Wrapping tools using -device-code-json present it themselves.
+	if !deviceCodeJSON && !isTerminal(os.Stdin) && !isTerminal(os.Stdout) {
+		err = errors.New("this sample signs in using a device code, which requires someone to act on it, but it isn't attached to a terminal. Run it interactively, or use -device-code-json to present the code from a wrapping tool")
+		return
+	}
+
+	err = abandonable(ctx, func() (initErr error) {
+		deviceCode, initErr = adal.InitiateDeviceAuth(&authClient, *config, clientID.String(), environment.ServiceManagementEndpoint)
+		return
+	})
+	if err != nil {
+		err = explainSignInFailure(err, rejection)
+		return
+	}
+
+	_, err = fmt.Println(*deviceCode.Message)
+	if err != nil {
+		return
+	}
+	statusLog.Print("Device Code Verification URL: ", to.String(deviceCode.VerificationURL))
+	statusLog.Print("Device Code User Code: ", to.String(deviceCode.UserCode))
+
+	if openBrowser {
+		presentDeviceCode(deviceCode)
+	}
+
+	if deviceCodeJSON {
+		var encoded []byte
+		encoded, err = json.Marshal(struct {
+			VerificationURL string `json:"verificationUrl"`
+			UserCode        string `json:"userCode"`
+			ExpiresIn       int64  `json:"expiresIn"`
+			Message         string `json:"message"`
+		}{
+			VerificationURL: to.String(deviceCode.VerificationURL),
+			UserCode:        to.String(deviceCode.UserCode),
+			ExpiresIn:       to.Int64(deviceCode.ExpiresIn),
+			Message:         to.String(deviceCode.Message),
+		})
+		if err != nil {
+			return
+		}
+		_, err = fmt.Println(string(encoded))
+		if err != nil {
+			return
+		}
+	}
+
+	var completed *adal.Token
+	err = abandonable(ctx, func() (waitErr error) {
+		completed, waitErr = adal.WaitForUserCompletion(&authClient, deviceCode)
+		return
+	})
+	if err != nil {
+		err = explainSignInFailure(err, rejection)
+		return
+	}
+	token = completed
+
+	if listTenants {
+		// Tenants are listed with the token from the common endpoint, rather than one for a single tenant.
+		return
+	}
+
+	if userTenantID == uuid.Nil {
+		var tenantCache []string
+		tenants, tenantErrs := getTenants(autorest.NewBearerAuthorizer(token))
+		for tenant := range tenants {
+			tenantCache = append(tenantCache, *tenant.TenantID)
+		}
+		err = <-tenantErrs
+		if err != nil {
+			return
+		}
+
+		if len(tenantCache) == 1 {
+			userTenantID, err = uuid.FromString(tenantCache[0])
+		} else {
+			err = errors.New("zero or multiple tenants associated with this account, use -tenant to choose one")
 			return
 		}
-		return
+	}
+
+	config, err = adal.NewOAuthConfig(environment.ActiveDirectoryEndpoint, userTenantID.String())
+
+	var spt *adal.ServicePrincipalToken
+	spt, err = adal.NewServicePrincipalTokenFromManualToken(*config, clientID.String(), environment.ResourceManagerEndpoint, *token)
+	if err != nil {
+		token = nil
+		return
+	}
+
+	token = &spt.Token
+	return
+}
+
+// interruptible returns a context that is cancelled if the user presses Ctrl+C before the returned func is called. Calling that func
+// restores the default handling of Ctrl+C.
+func interruptible() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+
+	go func() {
+		select {
+		case <-interrupts:
+			cancel()
+		case <-ctx.Done():
+		}
 	}()
 
-	return results, errs, deleter
+	return ctx, func() {
+		signal.Stop(interrupts)
+		cancel()
+	}
 }
 
-func setupVirtualNetwork(subscriptionID uuid.UUID, resourceGroup resources.Group, authorizer autorest.Authorizer) (<-chan network.VirtualNetwork, <-chan error) {
-	results, errs := make(chan network.VirtualNetwork, 1), make(chan error, 1)
-
+// abandonable runs op, but stops waiting for it once ctx is done. op is left to finish in the background, and its result is ignored.
+func abandonable(ctx context.Context, op func() error) error {
+	done := make(chan error, 1)
 	go func() {
-		defer close(errs)
-		defer close(results)
-
-		var tempErrs <-chan error
-		var created network.VirtualNetwork
-		var err error
+		done <- op()
+	}()
 
-		networkClient := network.NewVirtualNetworksClient(subscriptionID.String())
-		networkClient.Authorizer = authorizer
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-		const networkName = "sampleNetwork"
+// signInAdvice describes what to do about the Azure AD errors most likely to stop device code sign-in, by AADSTS code.
+// See: https://docs.microsoft.com/azure/active-directory/develop/reference-aadsts-error-codes
+var signInAdvice = map[int]string{
+	50020:   "the account isn't part of the tenant being signed in to. Use -tenant to choose a tenant the account belongs to",
+	50076:   "the tenant requires multi-factor authentication. Complete the additional verification when prompted in the browser, then try again",
+	50079:   "the account must register for multi-factor authentication before it can sign in. Complete registration in the browser, then try again",
+	50105:   "the account hasn't been assigned to the application used to sign in. Ask an administrator to assign it, or use -client-id to choose another application",
+	53000:   "the tenant's Conditional Access policies only allow sign-in from compliant devices. Sign in from a managed device",
+	53001:   "the tenant's Conditional Access policies only allow sign-in from domain joined devices. Sign in from a domain joined device",
+	53003:   "device code sign-in is blocked by the tenant's Conditional Access policies. Ask an administrator to allow it for this application, or use -client-id to choose an application that is allowed",
+	65001:   "the application used to sign in hasn't been granted consent in this tenant. Ask an administrator to consent to it, or use -client-id to choose another application",
+	700016:  "the application chosen with -client-id isn't registered in the tenant. Check -client-id and -tenant",
+	7000218: "the application chosen with -client-id isn't configured as a public client, so it can't use device code sign-in. Enable 'Allow public client flows' on its registration",
+}
 
-		_, tempErrs = networkClient.CreateOrUpdate(*resourceGroup.Name, networkName, network.VirtualNetwork{
-			Location: resourceGroup.Location,
-			VirtualNetworkPropertiesFormat: &network.VirtualNetworkPropertiesFormat{
-				AddressSpace: &network.AddressSpace{
-					AddressPrefixes: &[]string{
-						"192.168.0.0/16",
-					},
-				},
-			},
-		}, nil)
-		if err = <-tempErrs; err != nil {
-			errs <- err
-			return
-		}
+// withTokenErrors records the error Azure AD describes in any failed response into rejection.
+func withTokenErrors(rejection *adal.TokenError) autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			resp, err := s.Do(r)
+			if err != nil || resp.StatusCode == http.StatusOK || resp.Body == nil {
+				return resp, err
+			}
 
-		subnetClient := network.NewSubnetsClient(subscriptionID.String())
-		subnetClient.Authorizer = authorizer
+			body, readErr := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+			if readErr != nil {
+				return resp, readErr
+			}
 
-		const subnetName = "sampleSubnet"
+			// While the user hasn't finished signing in, polling is answered with errors that are only asking it to continue.
+			var described adal.TokenError
+			if json.Unmarshal(body, &described) == nil && len(described.ErrorCodes) > 0 {
+				switch to.String(described.Error) {
+				case "authorization_pending", "slow_down":
+				default:
+					*rejection = described
+				}
+			}
+			return resp, nil
+		})
+	}
+}
 
-		_, tempErrs = subnetClient.CreateOrUpdate(*resourceGroup.Name, networkName, "sampleSubnet", network.Subnet{
-			SubnetPropertiesFormat: &network.SubnetPropertiesFormat{
-				AddressPrefix: to.StringPtr("192.168.1.0/24"),
-			},
-		}, nil)
+// explainSignInFailure replaces err with advice on how to sign in successfully, when Azure AD rejected the sign-in for a reason that's
+// covered by signInAdvice.
+func explainSignInFailure(err error, rejection adal.TokenError) error {
+	for _, code := range rejection.ErrorCodes {
+		if advice, ok := signInAdvice[code]; ok {
+			return fmt.Errorf("could not sign in, because %s (AADSTS%d)", advice, code)
+		}
+	}
+	if rejection.ErrorDescription != nil {
+		// Azure AD follows the description with trace information that is only useful to its support staff.
+		description := strings.SplitN(*rejection.ErrorDescription, "\r\n", 2)[0]
+		return fmt.Errorf("%v: %s", err, description)
+	}
+	return err
+}
 
-		if err = <-tempErrs; err != nil {
-			errs <- err
-			return
+// presentDeviceCode makes a best effort to open the device login page in the default browser, and to put the user code on the clipboard.
+// Failures are only reported as debug information, because the sign-in instructions have already been printed.
+func presentDeviceCode(deviceCode *adal.DeviceCode) {
+	if deviceCode.VerificationURL != nil {
+		var open *exec.Cmd
+		switch runtime.GOOS {
+		case "windows":
+			open = exec.Command("cmd", "/c", "start", "", *deviceCode.VerificationURL)
+		case "darwin":
+			open = exec.Command("open", *deviceCode.VerificationURL)
+		default:
+			open = exec.Command("xdg-open", *deviceCode.VerificationURL)
+		}
+		if err := open.Start(); err != nil {
+			debugLog.Print("could not open browser: ", err)
 		}
+	}
 
-		created, err = networkClient.Get(*resourceGroup.Name, networkName, "")
-		if err != nil {
-			errs <- err
-			return
+	if deviceCode.UserCode != nil {
+		var clip *exec.Cmd
+		switch runtime.GOOS {
+		case "windows":
+			clip = exec.Command("clip")
+		case "darwin":
+			clip = exec.Command("pbcopy")
+		default:
+			clip = exec.Command("xclip", "-selection", "clipboard")
+		}
+		clip.Stdin = strings.NewReader(*deviceCode.UserCode)
+		if err := clip.Run(); err != nil {
+			debugLog.Print("could not copy user code to clipboard: ", err)
+		} else {
+			statusLog.Print("Copied user code to clipboard.")
 		}
+	}
+}
 
-		results <- created
-	}()
+// isTerminal determines whether f is attached to an interactive terminal, as opposed to a file, pipe, or nothing at all.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
 
-	return results, errs
+// armTemplate is an Azure Resource Manager deployment template.
+// See: https://docs.microsoft.com/azure/azure-resource-manager/resource-group-authoring-templates
+type armTemplate struct {
+	Schema         string                  `json:"$schema"`
+	ContentVersion string                  `json:"contentVersion"`
+	Parameters     map[string]armParameter `json:"parameters,omitempty"`
+	Variables      map[string]interface{}  `json:"variables,omitempty"`
+	Resources      []armResource           `json:"resources"`
+	Outputs        map[string]armParameter `json:"outputs,omitempty"`
 }
 
-func setupNetworkInterface(subscriptionID uuid.UUID, resourceGroup resources.Group, subnet network.Subnet, machine network.SubResource, authorizer autorest.Authorizer) (created network.Interface, err error) {
-	client := network.NewInterfacesClient(subscriptionID.String())
-	client.Authorizer = authorizer
+// armParameter describes either an input to, or an output of, an armTemplate.
+type armParameter struct {
+	Type         string      `json:"type"`
+	DefaultValue interface{} `json:"defaultValue,omitempty"`
+	Value        interface{} `json:"value,omitempty"`
+}
+
+// armResource is a single resource deployed by an armTemplate. Properties are populated with the same SDK models used when
+// creating the equivalent resource imperatively.
+type armResource struct {
+	Type       string                          `json:"type"`
+	APIVersion string                          `json:"apiVersion"`
+	Name       string                          `json:"name"`
+	Location   string                          `json:"location,omitempty"`
+	Kind       string                          `json:"kind,omitempty"`
+	Identity   *compute.VirtualMachineIdentity `json:"identity,omitempty"`
+	Tags       *map[string]*string             `json:"tags,omitempty"`
+	Sku        interface{}                     `json:"sku,omitempty"`
+	DependsOn  []string                        `json:"dependsOn,omitempty"`
+	Properties interface{}                     `json:"properties"`
+}
 
-	var ip network.PublicIPAddress
+// writeTemplate writes an Azure Resource Manager template to path, which deploys the same Virtual Network, Public IP Address,
+// Network Interface, Virtual Machine, and extension this sample would create imperatively.
+func writeTemplate(path string) error {
+	template := buildTemplate()
 
-	ip, err = setupPublicIP(subscriptionID, resourceGroup, authorizer)
+	encoded, err := json.MarshalIndent(template, "", "  ")
 	if err != nil {
-		return
+		return err
+	}
+	debugLog.Printf("Template Resources: %d", len(template.Resources))
+	return ioutil.WriteFile(path, append(encoded, '\n'), 0644)
+}
+
+// buildTemplate describes the assets created by this sample as an Azure Resource Manager template.
+// Resources reference one another using template functions like resourceId, and declare their ordering through dependsOn,
+// instead of being created one after the other.
+func buildTemplate() armTemplate {
+	const templateLocation = "[resourceGroup().location]"
+	const (
+		networkAPIVersion = "2017-03-01"
+		computeAPIVersion = "2016-04-30-preview"
+		storageAPIVersion = "2016-12-01"
+	)
+	const (
+		networkName       = "sampleNetwork"
+		subnetName        = "sampleSubnet"
+		securityGroupName = "sample-nsg"
+	)
+	diskName, snapshotDiskName := "sample-datadisk", "sample-osdisk"
+	if dataDiskName != "" {
+		diskName = dataDiskName
+	}
+	if osDiskName != "" {
+		snapshotDiskName = osDiskName
+	}
+	ipName := resourceName("sample-publicip")
+	interfaceName := resourceName(naming.NICName(0))
+	vmName := resourceName(naming.VMName(0))
+
+	subnetID := fmt.Sprintf("[resourceId('Microsoft.Network/virtualNetworks/subnets', '%s', '%s')]", networkName, subnetName)
+	ipID := fmt.Sprintf("[resourceId('Microsoft.Network/publicIPAddresses', '%s')]", ipName)
+	if publicIPID != "" {
+		ipID = publicIPID
+	}
+	interfaceID := fmt.Sprintf("[resourceId('Microsoft.Network/networkInterfaces', '%s')]", interfaceName)
+	diskID := fmt.Sprintf("[resourceId('Microsoft.Compute/disks', '%s')]", diskName)
+	networkID := fmt.Sprintf("[resourceId('Microsoft.Network/virtualNetworks', '%s')]", networkName)
+	storageID := "[resourceId('Microsoft.Storage/storageAccounts', variables('storageAccountName'))]"
+	vmID := "[resourceId('Microsoft.Compute/virtualMachines', parameters('vmName'))]"
+
+	template := armTemplate{
+		Schema:         "https://schema.management.azure.com/schemas/2015-01-01/deploymentTemplate.json#",
+		ContentVersion: "1.0.0.0",
+		Parameters: map[string]armParameter{
+			"vmName":        {Type: "string", DefaultValue: vmName},
+			"computerName":  {Type: "string", DefaultValue: computerName},
+			"adminPassword": {Type: "securestring"},
+		},
+		Variables: map[string]interface{}{
+			"storageAccountName": "[concat('sample', uniqueString(resourceGroup().id))]",
+		},
+	}
+	if computerName == "" {
+		template.Parameters["computerName"] = armParameter{Type: "string", DefaultValue: deriveComputerName(vmName)}
 	}
 
-	statusLog.Print("Created Public IP Address: ", *ip.Name, " ", *ip.IPAddress)
+	var backendPools *[]network.BackendAddressPool
+	if lbBackendPoolID != "" {
+		backendPools = &[]network.BackendAddressPool{{ID: to.StringPtr(lbBackendPoolID)}}
+	}
 
-	name := "sample-networkInterface"
+	profile := osProfile("[parameters('computerName')]")
+	profile.AdminPassword = to.StringPtr("[parameters('adminPassword')]")
 
-	_, errs := client.CreateOrUpdate(*resourceGroup.Name, name, network.Interface{
-		Location: resourceGroup.Location,
-		InterfacePropertiesFormat: &network.InterfacePropertiesFormat{
-			IPConfigurations: &[]network.InterfaceIPConfiguration{
-				{
-					Name: to.StringPtr(fmt.Sprintf("ipConfig-%s", *machine.ID)),
-					InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
-						PrivateIPAllocationMethod: network.Dynamic,
-						Primary:                   to.BoolPtr(true),
-						PublicIPAddress:           &ip,
-						Subnet:                    &subnet,
-					},
+	storageProfile := &compute.StorageProfile{
+		ImageReference: imageReference(),
+		OsDisk: &compute.OSDisk{
+			CreateOption: compute.FromImage,
+			Caching:      compute.CachingTypes(osDiskCaching),
+			DiskSizeGB:   to.Int32Ptr(64),
+		},
+		DataDisks: &[]compute.DataDisk{
+			{
+				CreateOption: compute.Attach,
+				Lun:          to.Int32Ptr(0),
+				ManagedDisk: &compute.ManagedDiskParameters{
+					ID:                 to.StringPtr(diskID),
+					StorageAccountType: compute.StandardLRS,
 				},
 			},
 		},
-	}, nil)
-	if err = <-errs; err != nil {
-		return
+	}
+	if osDiskName != "" {
+		storageProfile.OsDisk.Name = to.StringPtr(osDiskName)
+	}
+	var osDiskDependencies []string
+	if sourceSnapshot != "" {
+		// The snapshot's operating system is already configured, so there's nothing for an OS profile to do.
+		osDiskID := fmt.Sprintf("[resourceId('Microsoft.Compute/disks', '%s')]", snapshotDiskName)
+		template.Resources = append(template.Resources, armResource{
+			Type:       "Microsoft.Compute/disks",
+			APIVersion: computeAPIVersion,
+			Name:       snapshotDiskName,
+			Location:   templateLocation,
+			Properties: disk.Properties{
+				OsType: disk.OperatingSystemTypes(strings.Title(osType)),
+				CreationData: &disk.CreationData{
+					CreateOption:     disk.Copy,
+					SourceResourceID: to.StringPtr(sourceSnapshot),
+				},
+			},
+		})
+		osDiskDependencies = []string{osDiskID}
+
+		profile = nil
+		delete(template.Parameters, "computerName")
+		delete(template.Parameters, "adminPassword")
+		storageProfile.ImageReference = nil
+		storageProfile.OsDisk = &compute.OSDisk{
+			OsType:       compute.OperatingSystemTypes(strings.Title(osType)),
+			CreateOption: compute.Attach,
+			Caching:      compute.CachingTypes(osDiskCaching),
+			ManagedDisk:  &compute.ManagedDiskParameters{ID: to.StringPtr(osDiskID)},
+		}
 	}
 
-	created, err = client.Get(*resourceGroup.Name, name, "")
+	var networkDependencies, securityGroupDependencies []string
+	var subnetSecurityGroup, interfaceSecurityGroup *network.SecurityGroup
+	if createNSG {
+		securityGroupID := fmt.Sprintf("[resourceId('Microsoft.Network/networkSecurityGroups', '%s')]", securityGroupName)
+		if nsgScope == nsgScopeSubnet {
+			subnetSecurityGroup = &network.SecurityGroup{ID: to.StringPtr(securityGroupID)}
+			networkDependencies = []string{securityGroupID}
+		} else {
+			interfaceSecurityGroup = &network.SecurityGroup{ID: to.StringPtr(securityGroupID)}
+			securityGroupDependencies = []string{securityGroupID}
+		}
+		template.Resources = append(template.Resources, armResource{
+			Type:       "Microsoft.Network/networkSecurityGroups",
+			APIVersion: networkAPIVersion,
+			Name:       securityGroupName,
+			Location:   templateLocation,
+			Properties: network.SecurityGroupPropertiesFormat{},
+		})
+	}
 
-	return
-}
+	template.Resources = append(template.Resources, []armResource{
+		{
+			Type:       "Microsoft.Storage/storageAccounts",
+			APIVersion: storageAPIVersion,
+			Name:       "[variables('storageAccountName')]",
+			Location:   templateLocation,
+			Kind:       string(storage.Storage),
+			Sku:        storage.Sku{Name: storage.StandardLRS},
+			Properties: storage.AccountPropertiesCreateParameters{},
+		},
+	}...)
 
-func setupNetworkSecurityGroup(subscriptionID, resourceGroupName string, authorizer autorest.Authorizer) (created network.SecurityGroup, err error) {
-	client := network.NewSecurityGroupsClient(subscriptionID)
-	client.Authorizer = authorizer
+	// An existing subnet is referenced where it is, instead of being described by the template.
+	var subnetDependencies []string
+	if existingVNet != "" {
+		subnetID = fmt.Sprintf("[resourceId('%s', 'Microsoft.Network/virtualNetworks/subnets', '%s', '%s')]", vnetGroup, existingVNet, existingSubnet)
+	} else {
+		subnetDependencies = []string{networkID}
+		template.Resources = append(template.Resources, armResource{
+			Type:       "Microsoft.Network/virtualNetworks",
+			APIVersion: networkAPIVersion,
+			Name:       networkName,
+			Location:   templateLocation,
+			DependsOn:  networkDependencies,
+			Properties: network.VirtualNetworkPropertiesFormat{
+				AddressSpace: &network.AddressSpace{
+					AddressPrefixes: &[]string{"192.168.0.0/16"},
+				},
+				Subnets: &[]network.Subnet{
+					{
+						Name: to.StringPtr(subnetName),
+						SubnetPropertiesFormat: &network.SubnetPropertiesFormat{
+							AddressPrefix:        to.StringPtr("192.168.1.0/24"),
+							NetworkSecurityGroup: subnetSecurityGroup,
+						},
+					},
+				},
+			},
+		})
+	}
 
-	name := "sample-nsg"
+	var interfaceIP *network.PublicIPAddress
+	if !noPublicIP {
+		interfaceIP = &network.PublicIPAddress{ID: to.StringPtr(ipID)}
+	}
 
-	results, errs := client.CreateOrUpdate(resourceGroupName, name, network.SecurityGroup{
-		Location:                      to.StringPtr(location),
-		SecurityGroupPropertiesFormat: &network.SecurityGroupPropertiesFormat{},
-	}, nil)
-	created, err = <-results, <-errs
-	return
-}
+	var dnsSettings *network.PublicIPAddressDNSSettings
+	if dnsLabel != "" {
+		dnsSettings = &network.PublicIPAddressDNSSettings{DomainNameLabel: to.StringPtr(dnsLabel)}
+	}
 
-func setupPublicIP(subscriptionID uuid.UUID, group resources.Group, authorizer autorest.Authorizer) (created network.PublicIPAddress, err error) {
-	client := network.NewPublicIPAddressesClient(subscriptionID.String())
-	client.Authorizer = authorizer
+	interfaceDependencies := append(subnetDependencies, securityGroupDependencies...)
+	if publicIPID == "" && !noPublicIP {
+		template.Resources = append(template.Resources, armResource{
+			Type:       "Microsoft.Network/publicIPAddresses",
+			APIVersion: networkAPIVersion,
+			Name:       ipName,
+			Location:   templateLocation,
+			Properties: network.PublicIPAddressPropertiesFormat{
+				PublicIPAllocationMethod: network.Static,
+				DNSSettings:              dnsSettings,
+			},
+		})
+		interfaceDependencies = append(interfaceDependencies, ipID)
+	}
 
-	name := "sample-publicip"
+	vmDependencies := append([]string{storageID, interfaceID, diskID}, osDiskDependencies...)
+	networkCards := []compute.NetworkInterfaceReference{
+		{
+			ID: to.StringPtr(interfaceID),
+			NetworkInterfaceReferenceProperties: &compute.NetworkInterfaceReferenceProperties{
+				Primary: to.BoolPtr(true),
+			},
+		},
+	}
+	for i := 1; i < nicCount; i++ {
+		secondaryName := resourceName(naming.NICName(i))
+		secondaryID := fmt.Sprintf("[resourceId('Microsoft.Network/networkInterfaces', '%s')]", secondaryName)
+		template.Resources = append(template.Resources, armResource{
+			Type:       "Microsoft.Network/networkInterfaces",
+			APIVersion: networkAPIVersion,
+			Name:       secondaryName,
+			Location:   templateLocation,
+			DependsOn:  append(subnetDependencies, securityGroupDependencies...),
+			Properties: network.InterfacePropertiesFormat{
+				NetworkSecurityGroup: interfaceSecurityGroup,
+				EnableIPForwarding:   selectedIPForwarding(),
+				IPConfigurations: &[]network.InterfaceIPConfiguration{
+					{
+						Name: to.StringPtr("ipConfig"),
+						InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
+							PrivateIPAllocationMethod: network.Dynamic,
+							Primary:                   to.BoolPtr(true),
+							Subnet:                    &network.Subnet{ID: to.StringPtr(subnetID)},
+						},
+					},
+				},
+			},
+		})
+		vmDependencies = append(vmDependencies, secondaryID)
+		networkCards = append(networkCards, compute.NetworkInterfaceReference{
+			ID: to.StringPtr(secondaryID),
+			NetworkInterfaceReferenceProperties: &compute.NetworkInterfaceReferenceProperties{
+				Primary: to.BoolPtr(false),
+			},
+		})
+	}
 
-	_, errs := client.CreateOrUpdate(*group.Name, name, network.PublicIPAddress{
-		Location: group.Location,
-		PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
-			PublicIPAllocationMethod: network.Static,
+	template.Resources = append(template.Resources, []armResource{
+		{
+			Type:       "Microsoft.Network/networkInterfaces",
+			APIVersion: networkAPIVersion,
+			Name:       interfaceName,
+			Location:   templateLocation,
+			DependsOn:  interfaceDependencies,
+			Properties: network.InterfacePropertiesFormat{
+				NetworkSecurityGroup: interfaceSecurityGroup,
+				EnableIPForwarding:   selectedIPForwarding(),
+				IPConfigurations: &[]network.InterfaceIPConfiguration{
+					{
+						Name: to.StringPtr("ipConfig"),
+						InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
+							PrivateIPAllocationMethod:       network.Dynamic,
+							Primary:                         to.BoolPtr(true),
+							PublicIPAddress:                 interfaceIP,
+							Subnet:                          &network.Subnet{ID: to.StringPtr(subnetID)},
+							LoadBalancerBackendAddressPools: backendPools,
+						},
+					},
+				},
+			},
 		},
-	}, nil)
+		{
+			Type:       "Microsoft.Compute/disks",
+			APIVersion: computeAPIVersion,
+			Name:       diskName,
+			Location:   templateLocation,
+			Properties: disk.Properties{
+				CreationData: &disk.CreationData{
+					CreateOption: disk.Empty,
+				},
+				DiskSizeGB: to.Int32Ptr(64),
+			},
+		},
+		{
+			Type:       "Microsoft.Compute/virtualMachines",
+			APIVersion: computeAPIVersion,
+			Name:       "[parameters('vmName')]",
+			Location:   templateLocation,
+			Identity:   vmIdentity(),
+			DependsOn:  vmDependencies,
+			Properties: compute.VirtualMachineProperties{
+				LicenseType: selectedLicenseType(),
+				DiagnosticsProfile: &compute.DiagnosticsProfile{
+					BootDiagnostics: &compute.BootDiagnostics{
+						Enabled:    to.BoolPtr(true),
+						StorageURI: to.StringPtr("[reference(variables('storageAccountName')).primaryEndpoints.blob]"),
+					},
+				},
+				HardwareProfile: &compute.HardwareProfile{
+					VMSize: compute.VirtualMachineSizeTypes(vmSize),
+				},
+				NetworkProfile: &compute.NetworkProfile{
+					NetworkInterfaces: &networkCards,
+				},
+				OsProfile:      profile,
+				StorageProfile: storageProfile,
+			},
+		},
+	}...)
 
-	if err = <-errs; err != nil {
-		return
+	var extensions []compute.VirtualMachineExtension
+	if scriptContent != nil {
+		extensions = append(extensions, customScriptExtension(nil, scriptContent))
+	}
+	for _, current := range extensionTypes {
+		switch current {
+		case extensionVMAccess:
+			var password string
+			if accessPassword != "" {
+				template.Parameters["vmAccessPassword"] = armParameter{Type: "securestring"}
+				password = "[parameters('vmAccessPassword')]"
+			}
+			extensions = append(extensions, vmAccessExtension(nil, password))
+		case extensionMonitorAgent:
+			extensions = append(extensions, monitorAgentExtension(nil))
+		case extensionDiskEncryption:
+			// The Key Vault and key encryption key can't be described by a template, so they must be provided when deploying it.
+			template.Parameters["keyVaultUrl"] = armParameter{Type: "string"}
+			template.Parameters["keyEncryptionKeyUrl"] = armParameter{Type: "string"}
+			template.Parameters["aadClientSecret"] = armParameter{Type: "securestring"}
+			extensions = append(extensions, diskEncryptionExtension(nil, "[parameters('keyVaultUrl')]", "[parameters('keyEncryptionKeyUrl')]", "[parameters('aadClientSecret')]"))
+		}
 	}
 
-	created, err = client.Get(*group.Name, name, "")
-	return
-}
+	// Each extension waits for the one before it, so that they're installed in the same order as when this sample creates them.
+	previous := vmID
+	for _, extension := range extensions {
+		template.Resources = append(template.Resources, armResource{
+			Type:       "Microsoft.Compute/virtualMachines/extensions",
+			APIVersion: computeAPIVersion,
+			Name:       fmt.Sprintf("[concat(parameters('vmName'), '/%s')]", *extension.Name),
+			Location:   templateLocation,
+			DependsOn:  []string{previous},
+			Properties: extension.VirtualMachineExtensionProperties,
+		})
+		previous = fmt.Sprintf("[resourceId('Microsoft.Compute/virtualMachines/extensions', parameters('vmName'), '%s')]", *extension.Name)
+	}
 
-func setupStorageAccount(subscriptionID uuid.UUID, group resources.Group, authorizer autorest.Authorizer) (<-chan storage.Account, <-chan error) {
-	client := storage.NewAccountsClient(subscriptionID.String())
-	client.Authorizer = authorizer
+	if collectionRuleID != "" {
+		template.Resources = append(template.Resources, armResource{
+			Type:       "Microsoft.Compute/virtualMachines/providers/dataCollectionRuleAssociations",
+			APIVersion: dataCollectionAPIVersion,
+			Name:       fmt.Sprintf("[concat(parameters('vmName'), '/%s/sample-dcr-association')]", insightsProvider),
+			DependsOn:  []string{previous},
+			Properties: map[string]interface{}{
+				"dataCollectionRuleId": collectionRuleID,
+			},
+		})
+	}
 
-	storageAccountName := "sample"
-	storageAccountName = storageAccountName + string([]byte(uuid.NewV4().String())[:8])
-	storageAccountName = strings.ToLower(storageAccountName)
+	if !noPublicIP {
+		ipReference := fmt.Sprintf("[reference('%s').ipAddress]", ipName)
+		if publicIPID != "" {
+			ipReference = fmt.Sprintf("[reference('%s', '%s').ipAddress]", publicIPID, networkAPIVersion)
+		}
+		template.Outputs = map[string]armParameter{
+			"publicIPAddress": {Type: "string", Value: ipReference},
+		}
+		if dnsLabel != "" {
+			template.Outputs["fqdn"] = armParameter{Type: "string", Value: fmt.Sprintf("[reference('%s').dnsSettings.fqdn]", ipName)}
+		}
+	}
 
-	return client.Create(*group.Name, storageAccountName, storage.AccountCreateParameters{
-		Location: group.Location,
-		Sku: &storage.Sku{
-			Name: storage.StandardLRS,
-		},
-	}, nil)
+	for i := range template.Resources {
+		if kind, ok := templateTagKinds[template.Resources[i].Type]; ok {
+			template.Resources[i].Tags = resourceTags(kind)
+		}
+	}
+	return template
 }
 
-// authenticate gets an authorization token to allow clients to access Azure assets.
-func authenticate(clientID uuid.UUID) (token *adal.Token, err error) {
-	authClient := autorest.NewClientWithUserAgent("github.com/Azure-Samples/arm-compute-go-vm-extensions")
-	var deviceCode *adal.DeviceCode
-	var config *adal.OAuthConfig
-
-	config, err = adal.NewOAuthConfig(environment.ActiveDirectoryEndpoint, "common")
-	if err != nil {
-		return
+// selectSubscription determines which of the subscriptions available to the authenticated user should be used, asking the user to
+// choose if there is more than one.
+func selectSubscription(authorizer autorest.Authorizer) (selectedID uuid.UUID, err error) {
+	subscriptionResults, subscriptionErrs := getSubscriptions(authorizer)
+	var subscriptionCache []subscriptions.Subscription
+	for subscription := range subscriptionResults {
+		subscriptionCache = append(subscriptionCache, subscription)
 	}
-
-	deviceCode, err = adal.InitiateDeviceAuth(&authClient, *config, clientID.String(), environment.ServiceManagementEndpoint)
+	err = <-subscriptionErrs
 	if err != nil {
 		return
 	}
 
-	_, err = fmt.Println(*deviceCode.Message)
-	if err != nil {
-		return
+	var selectedSubscription subscriptions.Subscription
+	if subCount := len(subscriptionCache); subCount == 1 {
+		selectedSubscription = subscriptionCache[0]
+	} else {
+		var selected int
+		fmt.Println("Multiple subscriptions are associated with this account.\nPlease select the subscription you would like to use from the following list:")
+		for i, currentSub := range subscriptionCache {
+			fmt.Printf("\t%d) %s\n", i, *currentSub.DisplayName)
+		}
+		fmt.Print("Selection: ")
+		_, err = fmt.Scanf("%d", &selected)
+		if err != nil {
+			return
+		}
+		selectedSubscription = subscriptionCache[selected]
 	}
 
-	token, err = adal.WaitForUserCompletion(&authClient, deviceCode)
-	if err != nil {
-		return
-	}
+	return uuid.FromString(*selectedSubscription.SubscriptionID)
+}
 
-	var tenantCache []string
-	tenants, tenantErrs := getTenants(autorest.NewBearerAuthorizer(token))
-	for tenant := range tenants {
-		tenantCache = append(tenantCache, *tenant.TenantID)
+// cliProfile is the subset of the Azure CLI's azureProfile.json that this sample understands.
+type cliProfile struct {
+	Subscriptions []struct {
+		ID        string `json:"id"`
+		Name      string `json:"name"`
+		TenantID  string `json:"tenantId"`
+		IsDefault bool   `json:"isDefault"`
+	} `json:"subscriptions"`
+}
+
+// loadCLIDefaults reads the subscription and tenant the Azure CLI has been configured to use by default. If a subscription ID is
+// provided, the tenant of that subscription is returned instead.
+func loadCLIDefaults(subscriptionID string) (selectedSubscription, selectedTenant, name string, err error) {
+	home := os.Getenv("HOME")
+	if runtime.GOOS == "windows" {
+		home = os.Getenv("USERPROFILE")
+	}
+	profilePath := filepath.Join(home, ".azure", "azureProfile.json")
+	if configDir := os.Getenv("AZURE_CONFIG_DIR"); configDir != "" {
+		profilePath = filepath.Join(configDir, "azureProfile.json")
 	}
-	err = <-tenantErrs
+
+	var contents []byte
+	contents, err = ioutil.ReadFile(profilePath)
 	if err != nil {
 		return
 	}
+	// The Azure CLI writes this file with a UTF-8 byte order mark, which encoding/json doesn't accept.
+	contents = bytes.TrimPrefix(contents, []byte("\xef\xbb\xbf"))
 
-	if len(tenantCache) == 1 {
-		userTenantID, err = uuid.FromString(tenantCache[0])
-	} else {
-		err = errors.New("zero or multiple tenants associated with this account")
+	var profile cliProfile
+	if err = json.Unmarshal(contents, &profile); err != nil {
+		err = fmt.Errorf("could not parse '%s'. Error: %v", profilePath, err)
 		return
 	}
 
-	config, err = adal.NewOAuthConfig(environment.ActiveDirectoryEndpoint, userTenantID.String())
+	for _, subscription := range profile.Subscriptions {
+		if (subscriptionID == "" && subscription.IsDefault) || strings.EqualFold(subscription.ID, subscriptionID) {
+			return subscription.ID, subscription.TenantID, subscription.Name, nil
+		}
+	}
+	err = fmt.Errorf("no matching subscription found in '%s'", profilePath)
+	return
+}
 
-	var spt *adal.ServicePrincipalToken
-	spt, err = adal.NewServicePrincipalTokenFromManualToken(*config, clientID.String(), environment.ResourceManagerEndpoint, *token)
-	if err != nil {
-		token = nil
-		return
+// printTenants writes the IDs of the tenants the signed in account can access to stdout.
+func printTenants(authorizer autorest.Authorizer) error {
+	var ids []string
+	tenants, errs := getTenants(authorizer)
+	for tenant := range tenants {
+		ids = append(ids, to.String(tenant.TenantID))
+	}
+	if err := <-errs; err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return errors.New("the signed in account can't access any tenants. Check that it was invited to the tenant it should use, and that the invitation was accepted")
 	}
 
-	token = &spt.Token
-	return
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "TENANT ID")
+	for _, id := range ids {
+		fmt.Fprintln(table, id)
+	}
+	return table.Flush()
 }
 
 func getTenants(authorizer autorest.Authorizer) (<-chan subscriptions.TenantIDDescription, <-chan error) {
@@ -802,6 +5919,8 @@ func getTenants(authorizer autorest.Authorizer) (<-chan subscriptions.TenantIDDe
 
 		tenantClient := subscriptions.NewTenantsClient()
 		tenantClient.Authorizer = authorizer
+		tenantClient.Sender = sender
+		tenantClient.PollingDelay = pollInterval
 
 		var fetchTenants func() (subscriptions.TenantListResult, error)
 		fetchTenants = tenantClient.List
@@ -844,6 +5963,8 @@ func getSubscriptions(authorizer autorest.Authorizer) (<-chan subscriptions.Subs
 
 		client := subscriptions.NewGroupClient()
 		client.Authorizer = authorizer
+		client.Sender = sender
+		client.PollingDelay = pollInterval
 
 		var fetchSubscriptions func() (subscriptions.ListResult, error)
 		fetchSubscriptions = client.List
@@ -896,6 +6017,7 @@ func vaultAuthentication(clientID, tenantID uuid.UUID, token adal.Token) (author
 	if err != nil {
 		return
 	}
+	spt.SetSender(sender)
 
 	err = spt.Refresh()
 	if err != nil {
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/disk"
+	"github.com/Azure/azure-sdk-for-go/arm/keyvault"
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
+	"github.com/Azure/azure-sdk-for-go/arm/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/satori/uuid"
+)
+
+const testGroupID = "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/sample-rg"
+
+// fakeVMCreator records the VM it's asked to create, and reports it back as created.
+type fakeVMCreator struct {
+	groupName  string
+	vmName     string
+	parameters compute.VirtualMachine
+}
+
+func (machines *fakeVMCreator) CreateOrUpdate(resourceGroupName string, VMName string, parameters compute.VirtualMachine, cancel <-chan struct{}) (<-chan compute.VirtualMachine, <-chan error) {
+	machines.groupName, machines.vmName, machines.parameters = resourceGroupName, VMName, parameters
+
+	results, errs := make(chan compute.VirtualMachine, 1), make(chan error, 1)
+	results <- machines.created()
+	errs <- nil
+	close(results)
+	close(errs)
+	return results, errs
+}
+
+func (machines *fakeVMCreator) Get(resourceGroupName string, VMName string, expand compute.InstanceViewTypes) (compute.VirtualMachine, error) {
+	if resourceGroupName != machines.groupName || VMName != machines.vmName {
+		return compute.VirtualMachine{}, fmt.Errorf("VM '%s' was not created in '%s'", VMName, resourceGroupName)
+	}
+	return machines.created(), nil
+}
+
+func (machines *fakeVMCreator) created() compute.VirtualMachine {
+	created := machines.parameters
+	created.Name = to.StringPtr(machines.vmName)
+	created.ID = to.StringPtr(testGroupID + "/providers/Microsoft.Compute/virtualMachines/" + machines.vmName)
+	return created
+}
+
+// fakeNICCreator records each network interface it's asked to create, in order, and reports them back as created.
+type fakeNICCreator struct {
+	groupNames []string
+	parameters []network.Interface
+}
+
+func (interfaces *fakeNICCreator) CreateOrUpdate(resourceGroupName string, networkInterfaceName string, parameters network.Interface, cancel <-chan struct{}) (<-chan network.Interface, <-chan error) {
+	parameters.Name = to.StringPtr(networkInterfaceName)
+	interfaces.groupNames = append(interfaces.groupNames, resourceGroupName)
+	interfaces.parameters = append(interfaces.parameters, parameters)
+
+	results, errs := make(chan network.Interface, 1), make(chan error, 1)
+	results <- interfaces.created(parameters)
+	errs <- nil
+	close(results)
+	close(errs)
+	return results, errs
+}
+
+func (interfaces *fakeNICCreator) Get(resourceGroupName string, networkInterfaceName string, expand string) (network.Interface, error) {
+	for i, parameters := range interfaces.parameters {
+		if interfaces.groupNames[i] == resourceGroupName && *parameters.Name == networkInterfaceName {
+			return interfaces.created(parameters), nil
+		}
+	}
+	return network.Interface{}, fmt.Errorf("network interface '%s' was not created in '%s'", networkInterfaceName, resourceGroupName)
+}
+
+func (interfaces *fakeNICCreator) created(parameters network.Interface) network.Interface {
+	parameters.ID = to.StringPtr(testGroupID + "/providers/Microsoft.Network/networkInterfaces/" + *parameters.Name)
+	return parameters
+}
+
+// useTestSettings sets the flags that setupVirtualMachine and setupNetworkInterface read to values that keep them from calling Azure.
+func useTestSettings() {
+	started := time.Date(2017, time.October, 16, 9, 30, 0, 0, time.UTC)
+	naming = timestampNaming{started: started}
+	namePrefix, nameSuffix = "", ""
+	osType = osLinux
+	osDiskCaching = string(compute.ReadWrite)
+	osDiskName, computerName, licenseType = "", "", ""
+	vmSize = string(compute.StandardDS2V2)
+	adminUsername = "sampleuser"
+	nicCount = 1
+	noPublicIP = true
+	publicIPID, lbBackendPoolID = "", ""
+	ipForwarding = false
+	extensionTypes = extensionList{extensionDiskEncryption}
+	resourceTagSets = nil
+	summary = runSummary{}
+}
+
+func testGroup() resources.Group {
+	return resources.Group{
+		ID:       to.StringPtr(testGroupID),
+		Name:     to.StringPtr("sample-rg"),
+		Location: to.StringPtr("westus2"),
+	}
+}
+
+func testSubnet() network.Subnet {
+	return network.Subnet{
+		ID:   to.StringPtr(testGroupID + "/providers/Microsoft.Network/virtualNetworks/sample-vnet/subnets/sample-subnet"),
+		Name: to.StringPtr("sample-subnet"),
+	}
+}
+
+func TestSetupVirtualMachine(t *testing.T) {
+	useTestSettings()
+	// The default strategy, whose names are unique to each run, so the VM must be created under the name that provision settled on.
+	naming = guidNaming{id: uuid.NewV4()}
+	nicCount = 2
+
+	account := storage.Account{
+		ID:  to.StringPtr(testGroupID + "/providers/Microsoft.Storage/storageAccounts/sampleaccount"),
+		Sku: &storage.Sku{Name: storage.PremiumLRS},
+		AccountProperties: &storage.AccountProperties{
+			PrimaryEndpoints: &storage.Endpoints{Blob: to.StringPtr("https://sampleaccount.blob.core.windows.net/")},
+		},
+	}
+	dataDisk := disk.Model{ID: to.StringPtr(testGroupID + "/providers/Microsoft.Compute/disks/sample-datadisk")}
+
+	machines, interfaces := &fakeVMCreator{}, &fakeNICCreator{}
+	wantName := resourceName(naming.VMName(0))
+	created, err := setupVirtualMachine(machines, interfaces, uuid.NewV4(), uuid.NewV4(), uuid.NewV4(), testGroup(), wantName, account, keyvault.Vault{}, nil, dataDisk, nil, nil, testSubnet(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if machines.groupName != "sample-rg" || machines.vmName != wantName {
+		t.Errorf("got VM '%s' in '%s', want '%s' in 'sample-rg'", machines.vmName, machines.groupName, wantName)
+	}
+	if to.String(created.Name) != wantName {
+		t.Errorf("got created VM '%s', want '%s'", to.String(created.Name), wantName)
+	}
+
+	vm := machines.parameters
+	if to.String(vm.Location) != "westus2" {
+		t.Errorf("got location '%s', want 'westus2'", to.String(vm.Location))
+	}
+	if vm.Identity != nil {
+		t.Errorf("got identity %v, want none without the 'ama' extension", vm.Identity)
+	}
+	if vm.VirtualMachineProperties == nil {
+		t.Fatal("got no VM properties")
+	}
+	if vm.LicenseType != nil {
+		t.Errorf("got license type '%s', want none", *vm.LicenseType)
+	}
+	if got := vm.HardwareProfile.VMSize; got != compute.StandardDS2V2 {
+		t.Errorf("got size '%s', want '%s'", got, compute.StandardDS2V2)
+	}
+	if got := to.String(vm.DiagnosticsProfile.BootDiagnostics.StorageURI); got != "https://sampleaccount.blob.core.windows.net/" {
+		t.Errorf("got boot diagnostics storage '%s', want the account's blob endpoint", got)
+	}
+
+	storageProfile := vm.StorageProfile
+	if got := to.String(storageProfile.ImageReference.Offer); got != "UbuntuServer" {
+		t.Errorf("got image offer '%s', want 'UbuntuServer'", got)
+	}
+	if storageProfile.OsDisk.CreateOption != compute.FromImage || storageProfile.OsDisk.Caching != compute.ReadWrite {
+		t.Errorf("got OS disk created by '%s' with caching '%s', want '%s' with '%s'", storageProfile.OsDisk.CreateOption, storageProfile.OsDisk.Caching, compute.FromImage, compute.ReadWrite)
+	}
+	if storageProfile.DataDisks == nil || len(*storageProfile.DataDisks) != 1 {
+		t.Fatalf("got data disks %v, want exactly one", storageProfile.DataDisks)
+	}
+	attached := (*storageProfile.DataDisks)[0]
+	if to.String(attached.ManagedDisk.ID) != *dataDisk.ID || attached.ManagedDisk.StorageAccountType != compute.PremiumLRS {
+		t.Errorf("got data disk '%s' of type '%s', want '%s' of type '%s'", to.String(attached.ManagedDisk.ID), attached.ManagedDisk.StorageAccountType, *dataDisk.ID, compute.PremiumLRS)
+	}
+
+	profile := vm.OsProfile
+	if profile == nil {
+		t.Fatal("got no OS profile for a VM created from an image")
+	}
+	if to.String(profile.AdminUsername) != "sampleuser" || profile.LinuxConfiguration == nil || profile.WindowsConfiguration != nil {
+		t.Errorf("got OS profile for '%s' with Linux configuration %v and Windows configuration %v, want a Linux profile for 'sampleuser'", to.String(profile.AdminUsername), profile.LinuxConfiguration, profile.WindowsConfiguration)
+	}
+	if got, want := to.String(profile.ComputerName), deriveComputerName(wantName); got != want {
+		t.Errorf("got computer name '%s', want '%s'", got, want)
+	}
+
+	if len(interfaces.parameters) != 2 {
+		t.Fatalf("got %d network interfaces created, want 2", len(interfaces.parameters))
+	}
+	cards := *vm.NetworkProfile.NetworkInterfaces
+	if len(cards) != 2 {
+		t.Fatalf("got %d network interfaces attached, want 2", len(cards))
+	}
+	for i, card := range cards {
+		if want := interfaces.created(interfaces.parameters[i]).ID; to.String(card.ID) != *want {
+			t.Errorf("network interface %d: got '%s', want '%s'", i, to.String(card.ID), *want)
+		}
+		if got := to.Bool(card.Primary); got != (i == 0) {
+			t.Errorf("network interface %d: got primary %t, want %t", i, got, i == 0)
+		}
+	}
+}
+
+func TestSetupVirtualMachineFromSnapshot(t *testing.T) {
+	useTestSettings()
+
+	account := storage.Account{
+		ID:  to.StringPtr(testGroupID + "/providers/Microsoft.Storage/storageAccounts/sampleaccount"),
+		Sku: &storage.Sku{Name: storage.StandardLRS},
+		AccountProperties: &storage.AccountProperties{
+			PrimaryEndpoints: &storage.Endpoints{Blob: to.StringPtr("https://sampleaccount.blob.core.windows.net/")},
+		},
+	}
+	dataDisk := disk.Model{ID: to.StringPtr(testGroupID + "/providers/Microsoft.Compute/disks/sample-datadisk")}
+	osDisk := disk.Model{
+		ID:         to.StringPtr(testGroupID + "/providers/Microsoft.Compute/disks/sample-osdisk"),
+		Properties: &disk.Properties{OsType: disk.Linux},
+	}
+
+	machines := &fakeVMCreator{}
+	if _, err := setupVirtualMachine(machines, &fakeNICCreator{}, uuid.NewV4(), uuid.NewV4(), uuid.NewV4(), testGroup(), "sample-vm", account, keyvault.Vault{}, nil, dataDisk, &osDisk, nil, testSubnet(), nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := machines.parameters
+	if vm.OsProfile != nil {
+		t.Errorf("got OS profile %v, want none for an attached OS disk", vm.OsProfile)
+	}
+	osDiskParameters := vm.StorageProfile.OsDisk
+	if vm.StorageProfile.ImageReference != nil || osDiskParameters.CreateOption != compute.Attach {
+		t.Errorf("got image %v and OS disk created by '%s', want no image and '%s'", vm.StorageProfile.ImageReference, osDiskParameters.CreateOption, compute.Attach)
+	}
+	if osDiskParameters.ManagedDisk == nil || to.String(osDiskParameters.ManagedDisk.ID) != *osDisk.ID {
+		t.Errorf("got OS disk %v, want '%s'", osDiskParameters.ManagedDisk, *osDisk.ID)
+	}
+	if osDiskParameters.OsType != compute.Linux {
+		t.Errorf("got OS type '%s', want '%s'", osDiskParameters.OsType, compute.Linux)
+	}
+}
+
+func TestSetupNetworkInterface(t *testing.T) {
+	securityGroup := &network.SecurityGroup{ID: to.StringPtr(testGroupID + "/providers/Microsoft.Network/networkSecurityGroups/sample-nsg")}
+
+	testCases := []struct {
+		name           string
+		index          int
+		noPublicIP     bool
+		ipForwarding   bool
+		securityGroup  *network.SecurityGroup
+		wantForwarding *bool
+	}{
+		{"primary without public IP", 0, true, false, nil, nil},
+		{"primary with security group", 0, true, false, securityGroup, nil},
+		{"with IP forwarding", 0, true, true, nil, to.BoolPtr(true)},
+		// Only the primary interface is given a Public IP Address, so a secondary one doesn't create any.
+		{"secondary", 1, false, false, securityGroup, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			useTestSettings()
+			noPublicIP, ipForwarding = tc.noPublicIP, tc.ipForwarding
+
+			interfaces := &fakeNICCreator{}
+			machine := network.SubResource{ID: to.StringPtr("sample-vm")}
+			created, err := setupNetworkInterface(interfaces, uuid.NewV4(), testGroup(), testSubnet(), machine, tc.index, tc.securityGroup, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(interfaces.parameters) != 1 {
+				t.Fatalf("got %d network interfaces created, want 1", len(interfaces.parameters))
+			}
+			nic := interfaces.parameters[0]
+			if want := naming.NICName(tc.index); to.String(nic.Name) != want || interfaces.groupNames[0] != "sample-rg" {
+				t.Errorf("got '%s' in '%s', want '%s' in 'sample-rg'", to.String(nic.Name), interfaces.groupNames[0], want)
+			}
+			if to.String(created.ID) != *interfaces.created(nic).ID {
+				t.Errorf("got created network interface '%s', want '%s'", to.String(created.ID), *interfaces.created(nic).ID)
+			}
+			if to.String(nic.Location) != "westus2" {
+				t.Errorf("got location '%s', want 'westus2'", to.String(nic.Location))
+			}
+			if nic.NetworkSecurityGroup != tc.securityGroup {
+				t.Errorf("got security group %v, want %v", nic.NetworkSecurityGroup, tc.securityGroup)
+			}
+			if got := nic.EnableIPForwarding; (got == nil) != (tc.wantForwarding == nil) || got != nil && *got != *tc.wantForwarding {
+				t.Errorf("got IP forwarding %v, want %v", got, tc.wantForwarding)
+			}
+
+			configurations := *nic.IPConfigurations
+			if len(configurations) != 1 {
+				t.Fatalf("got %d IP configurations, want 1", len(configurations))
+			}
+			ipConfig := configurations[0]
+			if to.String(ipConfig.Name) != "ipConfig-sample-vm" {
+				t.Errorf("got IP configuration '%s', want 'ipConfig-sample-vm'", to.String(ipConfig.Name))
+			}
+			if ipConfig.PrivateIPAllocationMethod != network.Dynamic {
+				t.Errorf("got private IP allocation '%s', want '%s'", ipConfig.PrivateIPAllocationMethod, network.Dynamic)
+			}
+			if ipConfig.Subnet == nil || to.String(ipConfig.Subnet.ID) != *testSubnet().ID {
+				t.Errorf("got subnet %v, want '%s'", ipConfig.Subnet, *testSubnet().ID)
+			}
+			if ipConfig.PublicIPAddress != nil {
+				t.Errorf("got Public IP Address %v, want none", ipConfig.PublicIPAddress)
+			}
+		})
+	}
+}
+
+func TestNamingStrategies(t *testing.T) {
+	id, _ := uuid.FromString("0f8fad5b-d9cb-469f-a165-70867728950e")
+	guids := guidNaming{id: id}
+	stamped := timestampNaming{started: time.Date(2017, time.October, 16, 9, 30, 5, 0, time.FixedZone("PDT", -7*60*60))}
+
+	testCases := []struct {
+		name     string
+		got      string
+		want     string
+		wantRule nameRule
+	}{
+		{"guid group", guids.ResourceGroupName(), `sample-rg0f8fad5b-d9cb-469f-a165-70867728950e`, resourceGroupNameRule},
+		{"guid VM", guids.VMName(0), `sample-vm0f8fad5b-d9cb-469f-a165-70867728950e`, vmNameRule},
+		{"guid second VM", guids.VMName(1), `sample-vm0f8fad5b-d9cb-469f-a165-70867728950e-1`, vmNameRule},
+		{"guid NIC", guids.NICName(0), `sample-networkInterface`, networkNameRule},
+		{"guid second NIC", guids.NICName(1), `sample-networkInterface-1`, networkNameRule},
+		// The time the run started is always written in UTC, whatever zone it was recorded in.
+		{"timestamp group", stamped.ResourceGroupName(), `sample-rg-20171016-163005`, resourceGroupNameRule},
+		{"timestamp VM", stamped.VMName(0), `sample-vm-20171016-163005`, vmNameRule},
+		{"timestamp second VM", stamped.VMName(1), `sample-vm-20171016-163005-1`, vmNameRule},
+		{"timestamp NIC", stamped.NICName(0), `sample-networkInterface-20171016-163005`, networkNameRule},
+		{"timestamp second NIC", stamped.NICName(1), `sample-networkInterface-20171016-163005-1`, networkNameRule},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.got != tc.want {
+				t.Errorf("got '%s', want '%s'", tc.got, tc.want)
+			}
+			if err := tc.wantRule.validate(tc.got); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestNamingIsStableWithinARun(t *testing.T) {
+	names := func(strategy namingStrategy) []string {
+		return []string{strategy.ResourceGroupName(), strategy.VMName(0), strategy.VMName(1), strategy.NICName(0), strategy.NICName(1)}
+	}
+
+	testCases := []struct {
+		name   string
+		first  namingStrategy
+		second namingStrategy
+	}{
+		{"guid", guidNaming{id: uuid.NewV4()}, guidNaming{id: uuid.NewV4()}},
+		{"timestamp", timestampNaming{started: time.Now()}, timestampNaming{started: time.Now().Add(time.Second)}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run, again, other := names(tc.first), names(tc.first), names(tc.second)
+			for i := range run {
+				if run[i] != again[i] {
+					t.Errorf("got '%s', then '%s', want the same name each time within a run", run[i], again[i])
+				}
+			}
+			// Network interfaces are named alike in every run; they're only unique within their Resource Group.
+			for i := 0; i < 3; i++ {
+				if run[i] == other[i] {
+					t.Errorf("got '%s' for separate runs, want a different name for each", run[i])
+				}
+			}
+		})
+	}
+}
+
+// failedWith is the error the SDK returns when Azure answers a request with status, and with code in the body of its response if code
+// isn't empty.
+func failedWith(status int, code, message string) error {
+	detailed := autorest.DetailedError{StatusCode: status, Message: "Failure responding to request"}
+	if code != "" {
+		detailed.ServiceError = []byte(fmt.Sprintf(`{"error":{"code":%q,"message":%q}}`, code, message))
+	}
+	return detailed
+}
+
+func TestIsRetryable(t *testing.T) {
+	refused := &url.Error{
+		Op:  "Put",
+		URL: "https://management.azure.com/subscriptions",
+		Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+	}
+
+	testCases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no error", nil, false},
+		{"throttled", failedWith(http.StatusTooManyRequests, "", ""), true},
+		{"throttled by quota", failedWith(http.StatusTooManyRequests, "QuotaExceeded", "Operation could not be completed as it results in exceeding approved quota."), false},
+		{"internal server error", failedWith(http.StatusInternalServerError, "", ""), true},
+		{"bad gateway", failedWith(http.StatusBadGateway, "", ""), true},
+		{"service unavailable", failedWith(http.StatusServiceUnavailable, "", ""), true},
+		{"gateway timeout", failedWith(http.StatusGatewayTimeout, "", ""), true},
+		{"allocation failed", failedWith(http.StatusInternalServerError, "AllocationFailed", "Allocation failed."), false},
+		{"not found", failedWith(http.StatusNotFound, "", ""), true},
+		{"bad request", failedWith(http.StatusBadRequest, "InvalidParameter", "The value of parameter vmSize is invalid."), false},
+		{"unauthorized", failedWith(http.StatusUnauthorized, "", ""), false},
+		{"forbidden", failedWith(http.StatusForbidden, "AuthorizationFailed", "The client does not have authorization."), false},
+		{"conflict", failedWith(http.StatusConflict, "", ""), false},
+		{"operation in progress", failedWith(http.StatusConflict, "AnotherOperationInProgress", "Another operation is in progress."), true},
+		{"operation not allowed", failedWith(http.StatusBadRequest, "OperationNotAllowed", "Operation 'update' is not allowed while the VM is being updated."), true},
+		{"operation not allowed by quota", failedWith(http.StatusBadRequest, "OperationNotAllowed", "Operation results in exceeding quota limits of Core."), false},
+		{"unregistered", failedWith(http.StatusConflict, "MissingSubscriptionRegistration", "The subscription is not registered to use namespace 'Microsoft.Compute'."), false},
+		{"request error", azure.RequestError{ServiceError: &azure.ServiceError{Code: "RetryableError"}}, true},
+		{"connection refused", autorest.NewErrorWithError(refused, "compute.VirtualMachinesClient", "CreateOrUpdate", nil, "Failure sending request"), true},
+		{"timed out", &autorest.DetailedError{Original: &url.Error{Op: "Get", URL: "https://management.azure.com/subscriptions", Err: timeoutError{}}}, true},
+		{"unexpected", errors.New("unexpected end of JSON input"), false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isRetryable(tc.err); got != tc.want {
+				t.Errorf("got %t for %v, want %t", got, tc.err, tc.want)
+			}
+		})
+	}
+}
+
+// timeoutError is the error of a request that ran past -request-timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "Client.Timeout exceeded" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestWithRetry(t *testing.T) {
+	defer func(original time.Duration) { pollInterval = original }(pollInterval)
+	pollInterval = time.Millisecond
+
+	throttled := failedWith(http.StatusTooManyRequests, "", "")
+	forbidden := failedWith(http.StatusForbidden, "", "")
+
+	testCases := []struct {
+		name         string
+		failures     []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{"succeeds at once", nil, 1, nil},
+		{"succeeds after retries", []error{throttled, throttled}, 3, nil},
+		{"gives up", []error{throttled, throttled, throttled, throttled, throttled, throttled}, 5, throttled},
+		{"doesn't retry", []error{forbidden, throttled}, 1, forbidden},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			err := withRetry(func() error {
+				attempts++
+				if attempts <= len(tc.failures) {
+					return tc.failures[attempts-1]
+				}
+				return nil
+			})
+			if attempts != tc.wantAttempts {
+				t.Errorf("got %d attempts, want %d", attempts, tc.wantAttempts)
+			}
+			if fmt.Sprint(err) != fmt.Sprint(tc.wantErr) {
+				t.Errorf("got error %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	testCases := []struct {
+		name        string
+		body        string
+		contentType string
+		want        string
+	}{
+		{
+			"vault access policy",
+			`{"properties":{"accessPolicies":[{"permissions":{"keys":["get","wrapKey"],"secrets":["set"]}}]}}`,
+			"application/json; charset=utf-8",
+			`{"properties":{"accessPolicies":[{"permissions":{"keys":["get","wrapKey"],"secrets":["set"]}}]}}`,
+		},
+		{
+			"nested password",
+			`{"properties":{"osProfile":{"adminPassword":"azureRocksWithGo!","adminUsername":"sampleuser"}}}`,
+			"application/json",
+			`{"properties":{"osProfile":{"adminPassword":"` + redacted + `","adminUsername":"sampleuser"}}}`,
+		},
+		{
+			"list of resources",
+			`{"value":[{"name":"sample-vm"}]}`,
+			"application/json",
+			`{"value":[{"name":"sample-vm"}]}`,
+		},
+		{
+			"form",
+			`client_id=04b07795-8ddb-461a-bbee-02f9e1bf7b46&refresh_token=secret`,
+			"application/x-www-form-urlencoded",
+			`client_id=04b07795-8ddb-461a-bbee-02f9e1bf7b46&refresh_token=` + url.QueryEscape(redacted),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := redactBody([]byte(tc.body), tc.contentType); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildTemplateNames(t *testing.T) {
+	useTestSettings()
+	naming = guidNaming{id: uuid.NewV4()}
+	namePrefix, nameSuffix = "team-", "-dev"
+	nicCount = 2
+
+	template := buildTemplate()
+
+	if got, want := template.Parameters["vmName"].DefaultValue, resourceName(naming.VMName(0)); got != want {
+		t.Errorf("got VM name '%v', want '%s'", got, want)
+	}
+	var interfaceNames []string
+	for _, resource := range template.Resources {
+		if resource.Type == "Microsoft.Network/networkInterfaces" {
+			interfaceNames = append(interfaceNames, resource.Name)
+		}
+	}
+	// The secondary interfaces are described before the primary one, so only the names are compared.
+	want := []string{resourceName(naming.NICName(0)), resourceName(naming.NICName(1))}
+	sort.Strings(interfaceNames)
+	sort.Strings(want)
+	if fmt.Sprint(interfaceNames) != fmt.Sprint(want) {
+		t.Errorf("got network interfaces %v, want %v", interfaceNames, want)
+	}
+}
+
+func TestWithRecording(t *testing.T) {
+	const (
+		accountURL = "https://management.azure.com" + testGroupID + "/providers/Microsoft.Storage/storageAccounts/sampleaccount"
+		vaultURL   = "https://management.azure.com" + testGroupID + "/providers/Microsoft.KeyVault/vaults/sample-vault"
+		policy     = `{"properties":{"accessPolicies":[{"permissions":{"keys":["get","wrapKey"],"secrets":["set"]}}]}}`
+	)
+
+	testCases := []struct {
+		name         string
+		method       string
+		url          string
+		body         string
+		response     string
+		wantRequest  string
+		wantResponse string
+	}{
+		{
+			"storage account keys",
+			http.MethodPost, accountURL + "/listKeys?api-version=2016-12-01", "",
+			`{"keys":[{"keyName":"key1","permissions":"Full","value":"c2VjcmV0"},{"keyName":"key2","permissions":"Full","value":"c2VjcmV0"}]}`,
+			"",
+			`{"keys":"` + redacted + `"}`,
+		},
+		{
+			"vault access policy",
+			http.MethodPut, vaultURL + "?api-version=2015-06-01", policy,
+			policy,
+			policy,
+			policy,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "recording")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			service := autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": []string{"application/json; charset=utf-8"}},
+					Body:       ioutil.NopCloser(strings.NewReader(tc.response)),
+				}, nil
+			})
+			req, err := http.NewRequest(tc.method, tc.url, bytes.NewReader([]byte(tc.body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+			resp, err := autorest.DecorateSender(service, withRecording(dir)).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The response is only redacted in the recording; the caller still receives the keys.
+			if received, _ := ioutil.ReadAll(resp.Body); string(received) != tc.response {
+				t.Errorf("got response %s, want %s", received, tc.response)
+			}
+
+			recordings, err := filepath.Glob(filepath.Join(dir, "*.json"))
+			if err != nil || len(recordings) != 1 {
+				t.Fatalf("got recordings %v, want 1. Error: %v", recordings, err)
+			}
+			contents, err := ioutil.ReadFile(recordings[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var exchange recordedExchange
+			if err := json.Unmarshal(contents, &exchange); err != nil {
+				t.Fatal(err)
+			}
+			if exchange.RequestBody != tc.wantRequest {
+				t.Errorf("got request %s, want %s", exchange.RequestBody, tc.wantRequest)
+			}
+			if exchange.ResponseBody != tc.wantResponse {
+				t.Errorf("got response %s, want %s", exchange.ResponseBody, tc.wantResponse)
+			}
+		})
+	}
+}